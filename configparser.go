@@ -7,30 +7,44 @@ import (
 	"github.com/byrnedo/capitan/container"
 	"github.com/byrnedo/capitan/helpers"
 	"github.com/byrnedo/capitan/logger"
+	"github.com/byrnedo/capitan/shellsession"
 	"github.com/codegangsta/cli"
-	"github.com/codeskyblue/go-sh"
 	"github.com/mgutz/str"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
+// How long a blue/green deploy waits for the new container unless `ready-timeout` is given
+const defaultReadyTimeout = 60 * time.Second
+
 type ConfigParser struct {
 	// command to obtain config from
 	Command string
 	// args given to cli
 	Args cli.Args
 	// the container filter
-	Filter string
+	Filter ContainerFilter
+	// file to read config from instead of running Command,
+	// docker-compose files (.yml, .yaml) are converted
+	File string
+	// active profiles, services in other profiles are left out
+	Profiles []string
 }
 
-func NewSettingsParser(cmd string, args cli.Args, filter string) *ConfigParser {
+func NewSettingsParser(cmd string, args cli.Args, filter ContainerFilter, file string, profiles []string) *ConfigParser {
 	return &ConfigParser{
-		Command: cmd,
-		Args:    args,
-		Filter:  filter,
+		Command:  cmd,
+		Args:     args,
+		Filter:   filter,
+		File:     file,
+		Profiles: profiles,
 	}
 }
 
@@ -41,6 +55,14 @@ func (f *ConfigParser) Run() (*ProjectConfig, error) {
 		cmdSlice []string
 		cmdArgs  []interface{}
 	)
+	if f.File != "" {
+		if output, err = f.readFile(); err != nil {
+			return nil, err
+		}
+		absFile, _ := filepath.Abs(f.File)
+		return f.parseOutput(output, f.File, filepath.Dir(f.File), []string{absFile})
+	}
+
 	if len(f.Command) == 0 {
 		return nil, errors.New("Command must not be empty")
 	}
@@ -51,39 +73,161 @@ func (f *ConfigParser) Run() (*ProjectConfig, error) {
 		cmdArgs = []interface{}{}
 	}
 
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	if output, err = ses.Command(cmdSlice[0], cmdArgs...).Output(); err != nil {
 		return nil, err
 	}
-	settings, err := f.parseOutput(output)
+	// includes are relative to the config script, if it's a path
+	var dir string
+	if strings.ContainsRune(cmdSlice[0], filepath.Separator) {
+		dir = filepath.Dir(cmdSlice[0])
+	}
+	settings, err := f.parseOutput(output, f.Command, dir, nil)
 	return settings, err
 
 }
 
-func (f *ConfigParser) parseOutput(out []byte) (*ProjectConfig, error) {
-	lines := bytes.Split(out, []byte{'\n'})
+// Read config from File, converting it if it's a docker-compose file
+func (f *ConfigParser) readFile() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.File)
+	if err != nil {
+		return nil, err
+	}
+	switch path.Ext(f.File) {
+	case ".yml", ".yaml":
+		return composeToConfig(data, composeDefaultProject(f.File))
+	}
+	return data, nil
+}
+
+// A line of config and where it came from
+type configLine struct {
+	Text []byte
+	// file or command the line came from
+	Source string
+	// line number within Source, from 1
+	Num int
+}
+
+// Position of the line for error messages, eg "common.cfg:12"
+func (l configLine) Pos() string {
+	return fmt.Sprintf("%s:%d", l.Source, l.Num)
+}
+
+// how deep includes can nest, guards against commands including themselves
+const maxIncludeDepth = 32
+
+// Split config into lines, splicing in any includes.
+// dir is where relative includes are looked up, stack the includes currently being read.
+func (f *ConfigParser) readConfigLines(out []byte, source string, dir string, stack []string) ([]configLine, error) {
+	var lines []configLine
+	for i, text := range bytes.Split(out, []byte{'\n'}) {
+		line := configLine{
+			Text:   text,
+			Source: source,
+			Num:    i + 1,
+		}
+		lineParts := bytes.SplitN(bytes.TrimLeft(text, " "), []byte{' '}, 2)
+		if string(lineParts[0]) != "include" || len(lineParts) < 2 {
+			lines = append(lines, line)
+			continue
+		}
+		included, err := f.include(strings.TrimSpace(string(lineParts[1])), line, dir, stack)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, included...)
+	}
+	return lines, nil
+}
+
+// Read the lines for an `include` line.
+// Executable files and commands are run and their output used, other files are read.
+func (f *ConfigParser) include(target string, from configLine, dir string, stack []string) ([]configLine, error) {
+	var (
+		output []byte
+		source string
+		key    string
+		err    error
+	)
+	fail := func(msg string) error {
+		return errors.New(fmt.Sprintf("Failed to include `%s` on %s, %s", target, from.Pos(), msg))
+	}
+
+	if len(stack) >= maxIncludeDepth {
+		return nil, fail("includes nested too deeply")
+	}
+	argv := str.ToArgv(target)
+	if len(argv) == 0 {
+		return nil, fail("nothing to include")
+	}
+
+	filePath := argv[0]
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(dir, filePath)
+	}
+
+	if info, statErr := os.Stat(filePath); statErr == nil && !info.IsDir() {
+		source = filePath
+		if key, err = filepath.Abs(filePath); err != nil {
+			return nil, fail(err.Error())
+		}
+		if helpers.StringInSlice(key, stack) {
+			return nil, fail("it includes itself")
+		}
+		if info.Mode()&0111 != 0 {
+			// relative paths in the command's output are relative to it
+			output, err = shellsession.NewSession().SetDir(filepath.Dir(key)).Command(key, helpers.ToInterfaceSlice(argv[1:])...).Output()
+		} else if len(argv) > 1 {
+			return nil, fail("arguments given but file is not executable")
+		} else {
+			output, err = ioutil.ReadFile(filePath)
+		}
+		dir = filepath.Dir(filePath)
+	} else {
+		// a command on the PATH
+		source = target
+		key = "command:" + dir + ":" + target
+		if helpers.StringInSlice(key, stack) {
+			return nil, fail("it includes itself")
+		}
+		output, err = shellsession.NewSession().SetDir(dir).Command(argv[0], helpers.ToInterfaceSlice(argv[1:])...).Output()
+	}
+	if err != nil {
+		return nil, fail(err.Error())
+	}
+	return f.readConfigLines(output, source, dir, append(stack, key))
+}
+
+func (f *ConfigParser) parseOutput(out []byte, source string, dir string, stack []string) (*ProjectConfig, error) {
+	lines, err := f.readConfigLines(out, source, dir, stack)
+	if err != nil {
+		return nil, err
+	}
 	settings, err := f.parseSettings(lines)
 	return settings, err
 
 }
 
 // The main parse function. Creates the final list of containers.
-func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfig, err error) {
+func (f *ConfigParser) parseSettings(lines []configLine) (projSettings *ProjectConfig, err error) {
 	//minimum of len1 at this point in parts
 
-	cmdsMap := make(map[string]container.Container, 0)
+	raw := &rawConfig{
+		Services:  make(map[string][]directive),
+		Templates: make(map[string][]directive),
+		Instances: make(map[string]map[int][]directive),
+	}
 
-	projName, _ := os.Getwd()
-	projName = toSnake(path.Base(projName))
-	projNameArr := strings.Split(projName, "_")
 	projSettings = new(ProjectConfig)
-	projSettings.ProjectName = projNameArr[len(projNameArr)-1]
-	projSettings.ProjectSeparator = "_"
+	projSettings.ProjectName = defaultProjectName()
+	projSettings.ProjectSeparator = defaultProjectSeparator
+	projSettings.NameTemplate = helpers.DefaultNames
 	projSettings.Hooks = make(Hooks)
 
-	for lineNum, line := range lines {
+	for _, confLine := range lines {
 
-		line = bytes.TrimLeft(line, " ")
+		line := bytes.TrimLeft(confLine.Text, " ")
 		if len(line) == 0 || line[0] == '#' {
 			//comment
 			continue
@@ -103,6 +247,35 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 					projSettings.ProjectSeparator = stripChars(string(lineParts[2]), " \t")
 				case "blue_green":
 					projSettings.BlueGreenMode, _ = strconv.ParseBool(string(lineParts[2]))
+				case "name_template":
+					text := strings.TrimSpace(string(lineParts[2]))
+					if projSettings.NameTemplate, err = helpers.NewNameTemplate(text); err != nil {
+						return projSettings, errors.New(fmt.Sprintf("Failed to parse `name_template` on %s, %s", confLine.Pos(), err))
+					}
+				case "network":
+					projSettings.Network = strings.TrimSpace(string(lineParts[2]))
+				case "discovery_file", "discovery_hosts":
+					if projSettings.Discovery == nil {
+						projSettings.Discovery = new(DiscoveryConfig)
+					}
+					if string(lineParts[1]) == "discovery_file" {
+						projSettings.Discovery.File = strings.TrimSpace(string(lineParts[2]))
+					} else {
+						projSettings.Discovery.Hosts = strings.TrimSpace(string(lineParts[2]))
+					}
+				case "proxy_template", "proxy_output", "proxy_reload":
+					if projSettings.Proxy == nil {
+						projSettings.Proxy = new(ProxyConfig)
+					}
+					value := strings.TrimSpace(string(lineParts[2]))
+					switch string(lineParts[1]) {
+					case "proxy_template":
+						projSettings.Proxy.Template = value
+					case "proxy_output":
+						projSettings.Proxy.Output = value
+					default:
+						projSettings.Proxy.Reload = value
+					}
 				case "hook":
 					hookAndCommand := bytes.SplitN(lineParts[2], []byte{' '}, 2)
 					if len(hookAndCommand) == 2 {
@@ -115,184 +288,634 @@ func (f *ConfigParser) parseSettings(lines [][]byte) (projSettings *ProjectConfi
 						hook.Scripts = append(hook.Scripts, hookScript)
 						projSettings.Hooks[hookName] = hook
 					}
+				case "default":
+					// global default <directive> <args>
+					raw.Defaults = append(raw.Defaults, newDirective(lineParts[2], confLine))
+				case "label":
+					raw.Defaults = append(raw.Defaults, directive{
+						Action: "label",
+						Args:   strings.TrimRight(string(lineParts[2]), " "),
+						Line:   confLine,
+					})
 				}
 			}
 			continue
 
 		}
 
+		if string(lineParts[0]) == "template" {
+			// template <name> <directive> <args>
+			if len(lineParts) < 3 {
+				continue
+			}
+			name := string(lineParts[1])
+			raw.Templates[name] = append(raw.Templates[name], newDirective(lineParts[2], confLine))
+			continue
+		}
+
 		contr := string(lineParts[0])
+		d := newDirective(line[len(lineParts[0])+1:], confLine)
 
-		if _, found := cmdsMap[contr]; !found {
-			cmdsMap[contr] = container.Container{
-				Placement: len(cmdsMap),
-				Hooks:     make(map[string]*container.Hook, 0),
-				Scale:     1,
-				BlueGreenMode: container.BGModeUnknown,
-				Enabled: true,
+		// instance override, eg. app#2 env ROLE=leader
+		if i := strings.LastIndex(contr, "#"); i >= 0 {
+			num, convErr := strconv.Atoi(contr[i+1:])
+			if convErr != nil || num < 1 {
+				return projSettings, errors.New(fmt.Sprintf("Failed to parse `%s` on %s, instance must be a number from 1", contr, confLine.Pos()))
 			}
+			contr = contr[:i]
+			if raw.Instances[contr] == nil {
+				raw.Instances[contr] = make(map[int][]directive)
+			}
+			raw.Instances[contr][num] = append(raw.Instances[contr][num], d)
+			continue
 		}
 
-		action := string(lineParts[1])
-		setting := cmdsMap[contr]
+		if _, found := raw.Services[contr]; !found {
+			raw.Order = append(raw.Order, contr)
+		}
+		raw.Services[contr] = append(raw.Services[contr], d)
+	}
 
-		var args string
-		if len(lineParts) > 2 {
-			args = string(lineParts[2])
+	if projSettings.Proxy != nil {
+		if projSettings.Proxy.Template == "" {
+			return projSettings, errors.New("`proxy_template` must be given to generate proxy config")
 		}
-		args = strings.TrimRight(args, " ")
-		switch action {
-		case "command":
-			if len(args) > 0 {
-				parsedArgs := str.ToArgv(args)
-				for _, arg := range parsedArgs {
-					setting.Command = append(setting.Command, arg)
-				}
+		if err = projSettings.Proxy.load(); err != nil {
+			return projSettings, errors.New("Failed to load proxy template: " + err.Error())
+		}
+	}
+
+	var containersState map[string]*helpers.ServiceState
+	if containersState, err = helpers.GetProjectState(projSettings.ProjectName, projSettings.ProjectSeparator, projSettings.NameTemplate); err != nil {
+		return
+	}
+	// Post process
+	err = f.postProcessConfig(raw, projSettings, containersState)
+	return
+
+}
+
+// A single `<directive> <args>` for a service or template
+type directive struct {
+	Action string
+	Args   string
+	Line   configLine
+}
+
+func newDirective(text []byte, line configLine) directive {
+	parts := bytes.SplitN(text, []byte{' '}, 2)
+	d := directive{
+		Action: string(parts[0]),
+		Line:   line,
+	}
+	if len(parts) > 1 {
+		d.Args = strings.TrimRight(string(parts[1]), " ")
+	}
+	return d
+}
+
+// Config as read, before templates are expanded
+type rawConfig struct {
+	// services in the order they first appear
+	Order     []string
+	Services  map[string][]directive
+	Templates map[string][]directive
+	// overrides for single instances of a service, eg. app#2
+	Instances map[string]map[int][]directive
+	// `global default` and `global label` lines, the base of every service
+	Defaults []directive
+}
+
+// Directives which set a single value. When a service sets one of these
+// any inherited through `extends` are dropped, all other directives are appended.
+var scalarDirectives = map[string]bool{
+	"image":         true,
+	"build":         true,
+	"build-args":    true,
+	"command":       true,
+	"scale":         true,
+	"rm":            true,
+	"blue-green":    true,
+	"enabled":       true,
+	"stable-name":   true,
+	"ready-timeout": true,
+	"drain-delay":   true,
+	"hostname":      true,
+	"domainname":    true,
+	"restart":       true,
+	"log-driver":    true,
+	"user":          true,
+	"workdir":       true,
+	"entrypoint":    true,
+	"memory":        true,
+	"memory-swap":   true,
+	"cpu-shares":    true,
+	"cpus":          true,
+	"cpuset-cpus":   true,
+	"net":           true,
+	"network":       true,
+	"ipc":           true,
+	"pid":           true,
+	"stop-signal":   true,
+	"stop-timeout":  true,
+	"shm-size":      true,
+	"health-cmd":    true,
+	"mac-address":   true,
+	"ip":            true,
+}
+
+// Put own directives on top of inherited ones
+func mergeDirectives(inherited []directive, own []directive) []directive {
+	overridden := make(map[string]bool)
+	for _, d := range own {
+		if scalarDirectives[d.Action] {
+			overridden[d.Action] = true
+		}
+	}
+	merged := make([]directive, 0, len(inherited)+len(own))
+	for _, d := range inherited {
+		if !overridden[d.Action] {
+			merged = append(merged, d)
+		}
+	}
+	return append(merged, own...)
+}
+
+// Resolve the `extends` directives in own, giving the full list of directives.
+// stack holds the templates and services currently being expanded.
+func (f *ConfigParser) expandDirectives(name string, own []directive, raw *rawConfig, stack []string) ([]directive, error) {
+	var (
+		inherited []directive
+		local     []directive
+	)
+	stack = append(stack, name)
+	for _, d := range own {
+		if d.Action != "extends" {
+			local = append(local, d)
+			continue
+		}
+		base := strings.TrimSpace(d.Args)
+		key := "template:" + base
+		baseDirectives, found := raw.Templates[base]
+		if !found {
+			key = "service:" + base
+			baseDirectives, found = raw.Services[base]
+		}
+		if !found {
+			return nil, errors.New(fmt.Sprintf("Failed to parse `extends` on %s, no template or service named %s", d.Line.Pos(), base))
+		}
+		if helpers.StringInSlice(key, stack) {
+			return nil, errors.New(fmt.Sprintf("Failed to parse `extends` on %s, %s extends itself", d.Line.Pos(), base))
+		}
+		expanded, err := f.expandDirectives(key, baseDirectives, raw, stack)
+		if err != nil {
+			return nil, err
+		}
+		inherited = mergeDirectives(inherited, expanded)
+	}
+	return mergeDirectives(inherited, local), nil
+}
+
+// Directives which apply to a whole service and can't be overridden for one instance
+var serviceOnlyDirectives = []string{"scale", "enabled", "profile"}
+
+// Expand templates and build a container for each service,
+// and for each instance which has overrides
+func (f *ConfigParser) expandServices(raw *rawConfig) (map[string]container.Container, map[string]map[int]container.Container, error) {
+	cmdsMap := make(map[string]container.Container, len(raw.Order))
+	instancesMap := make(map[string]map[int]container.Container)
+	defaults, err := f.expandDirectives("global:default", raw.Defaults, raw, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, name := range raw.Order {
+		directives, err := f.expandDirectives("service:"+name, raw.Services[name], raw, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		directives = mergeDirectives(defaults, directives)
+		if cmdsMap[name], err = newServiceContainer(i, directives); err != nil {
+			return nil, nil, err
+		}
+
+		for num, own := range raw.Instances[name] {
+			key := fmt.Sprintf("instance:%s#%d", name, num)
+			overrides, err := f.expandDirectives(key, own, raw, nil)
+			if err != nil {
+				return nil, nil, err
 			}
-		case "scale":
-			if len(args) > 0 {
-				scale, err := strconv.Atoi(args)
-				if err != nil {
-					return projSettings, errors.New(fmt.Sprintf("Failed to parse `scale` on line %d, %s", lineNum+1, err))
+			for _, d := range overrides {
+				if helpers.StringInSlice(d.Action, serviceOnlyDirectives) {
+					return nil, nil, errors.New(fmt.Sprintf("Failed to parse `%s` on %s, it can't be set for a single instance", d.Action, d.Line.Pos()))
 				}
-				if scale < 1 {
-					scale = 1
-				}
-				setting.Scale = scale
 			}
-		case "image":
-			if len(args) > 0 {
-				setting.Image = args
+			if instancesMap[name] == nil {
+				instancesMap[name] = make(map[int]container.Container)
 			}
-		case "build":
-			if len(args) > 0 {
-				setting.Build = args
+			if instancesMap[name][num], err = newServiceContainer(i, mergeDirectives(directives, overrides)); err != nil {
+				return nil, nil, err
 			}
-		case "build-args":
-			if len(args) > 0 {
-				setting.BuildArgs = str.ToArgv(args)
+		}
+	}
+	for name, instances := range raw.Instances {
+		if _, found := raw.Services[name]; !found {
+			for num := range instances {
+				return nil, nil, errors.New(fmt.Sprintf("Failed to parse `%s#%d` on %s, no service named %s", name, num, instances[num][0].Line.Pos(), name))
 			}
-		case "link":
+		}
+	}
 
-			argParts := strings.SplitN(args, ":", 2)
+	// services are run after those they take addresses from
+	order, err := orderByServiceEnvs(raw.Order, cmdsMap, instancesMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw.Order = order
+	for i, name := range order {
+		svc := cmdsMap[name]
+		svc.Placement = i
+		cmdsMap[name] = svc
+		for num, instance := range instancesMap[name] {
+			instance.Placement = i
+			instancesMap[name][num] = instance
+		}
+	}
+	return cmdsMap, instancesMap, nil
+}
 
-			var alias string
-			if len(argParts) > 1 {
-				alias = argParts[1]
+// Put each service after the services it has `env-from-service` for, otherwise keeping the config's order
+func orderByServiceEnvs(order []string, services map[string]container.Container, instances map[string]map[int]container.Container) ([]string, error) {
+	var (
+		sorted   = make([]string, 0, len(order))
+		done     = make(map[string]bool, len(order))
+		visiting = make(map[string]bool)
+		visit    func(name string, path []string) error
+	)
+	visit = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		path = append(path, name)
+		if visiting[name] {
+			return errors.New("`env-from-service` refers in a circle: " + strings.Join(path, " -> "))
+		}
+		visiting[name] = true
+
+		envs := services[name].ServiceEnvs
+		for _, instance := range instances[name] {
+			envs = append(envs, instance.ServiceEnvs...)
+		}
+		for _, env := range envs {
+			if _, found := services[env.Service]; !found {
+				return errors.New(fmt.Sprintf("%s sets %s from %s, which isn't a service in the config", name, env.Var, env.Service))
 			}
+			if err := visit(env.Service, path); err != nil {
+				return err
+			}
+		}
+
+		visiting[name] = false
+		done[name] = true
+		sorted = append(sorted, name)
+		return nil
+	}
+	for _, name := range order {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
 
-			newLink := container.Link{
-				Container: argParts[0],
-				Alias:     alias,
+// Build a service's settings from its directives
+func newServiceContainer(placement int, directives []directive) (container.Container, error) {
+	setting := container.Container{
+		Placement:     placement,
+		Hooks:         make(map[string]*container.Hook, 0),
+		Scale:         1,
+		BlueGreenMode: container.BGModeUnknown,
+		Enabled:       true,
+		ReadyTimeout:  defaultReadyTimeout,
+	}
+	for _, d := range directives {
+		if err := applyDirective(&setting, d); err != nil {
+			return setting, err
+		}
+	}
+	return setting, nil
+}
+
+// Apply a single directive to a service's settings
+func applyDirective(setting *container.Container, d directive) error {
+	action, args := d.Action, d.Args
+	switch action {
+	case "command":
+		parsedArgs, err := splitRunArgs(d, args)
+		if err != nil {
+			return err
+		}
+		setting.Command = append(setting.Command, parsedArgs...)
+	case "scale":
+		if len(args) > 0 {
+			scale, err := strconv.Atoi(args)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to parse `scale` on %s, %s", d.Line.Pos(), err))
 			}
+			if scale < 1 {
+				scale = 1
+			}
+			setting.Scale = scale
+		}
+	case "image":
+		if len(args) > 0 {
+			setting.Image = args
+		}
+	case "build":
+		if len(args) > 0 {
+			setting.Build = args
+		}
+	case "build-args":
+		if len(args) > 0 {
+			setting.BuildArgs = str.ToArgv(args)
+		}
+	case "link":
+		if err := checkDirectiveTemplate(d, args); err != nil {
+			return err
+		}
 
-			setting.Links = append(setting.Links, newLink)
-
-		case "rm":
-			setting.Remove = true
-		case "hook":
-			if len(args) > 0 {
-				curHooks := setting.Hooks
-				argParts := strings.SplitN(args, " ", 2)
-				hookName := argParts[0]
-				if len(argParts) > 1 {
-					hookScript := argParts[1]
-
-					hook := curHooks[hookName]
-					if hook == nil {
-						hook = new(container.Hook)
-					}
-					hook.Scripts = append(hook.Scripts, hookScript)
-					curHooks[hookName] = hook
+		argParts := strings.SplitN(args, ":", 2)
+
+		var alias string
+		if len(argParts) > 1 {
+			alias = argParts[1]
+		}
+
+		newLink := container.Link{
+			Container: argParts[0],
+			Alias:     alias,
+		}
+
+		setting.Links = append(setting.Links, newLink)
+
+	case "rm":
+		setting.Remove = true
+	case "hook":
+		if len(args) > 0 {
+			curHooks := setting.Hooks
+			argParts := strings.SplitN(args, " ", 2)
+			hookName := argParts[0]
+			if len(argParts) > 1 {
+				hookScript := argParts[1]
+
+				hook := curHooks[hookName]
+				if hook == nil {
+					hook = new(container.Hook)
 				}
-				setting.Hooks = curHooks
+				hook.Scripts = append(hook.Scripts, hookScript)
+				curHooks[hookName] = hook
 			}
-		case "blue-green":
-			if len(args) > 0 {
-				isBGMode, _ := strconv.ParseBool(args)
-				if isBGMode {
-					setting.BlueGreenMode = container.BGModeOn
-				} else {
-					setting.BlueGreenMode = container.BGModeOff
-				}
+			setting.Hooks = curHooks
+		}
+	case "blue-green":
+		if len(args) > 0 {
+			isBGMode, _ := strconv.ParseBool(args)
+			if isBGMode {
+				setting.BlueGreenMode = container.BGModeOn
+			} else {
+				setting.BlueGreenMode = container.BGModeOff
 			}
-		case "enabled":
-			if len(args) > 0 {
-				setting.Enabled, _ = strconv.ParseBool(args)
+		}
+	case "enabled":
+		if len(args) > 0 {
+			setting.Enabled, _ = strconv.ParseBool(args)
+		}
+	case "volumes-from":
+		if err := checkDirectiveTemplate(d, args); err != nil {
+			return err
+		}
+		argParts := strings.SplitN(args, " ", 2)
+		setting.VolumesFrom = append(setting.VolumesFrom, argParts[0])
+	case "depends-on":
+		for _, dep := range strings.Fields(args) {
+			setting.DependsOn = append(setting.DependsOn, dep)
+		}
+	case "profile":
+		setting.Profiles = append(setting.Profiles, strings.Fields(args)...)
+	case "env-from-service":
+		// env-from-service VAR service[:port]
+		argParts := strings.Fields(args)
+		if len(argParts) != 2 {
+			return errors.New(fmt.Sprintf("Failed to parse `env-from-service` on %s, expected a variable and a service", d.Line.Pos()))
+		}
+		env := container.ServiceEnv{Var: argParts[0], Service: argParts[1]}
+		if i := strings.LastIndex(env.Service, ":"); i >= 0 {
+			env.Service, env.Port = env.Service[:i], env.Service[i+1:]
+			if port, err := strconv.Atoi(env.Port); err != nil || port < 1 || port > 65535 {
+				return errors.New(fmt.Sprintf("Failed to parse `env-from-service` on %s, invalid port %s", d.Line.Pos(), env.Port))
 			}
-		case "volumes-from":
-			argParts := strings.SplitN(args, " ", 2)
-			setting.VolumesFrom = append(setting.VolumesFrom, argParts[0])
-		case "global":
+		}
+		if env.Service == "" {
+			return errors.New(fmt.Sprintf("Failed to parse `env-from-service` on %s, service is empty", d.Line.Pos()))
+		}
+		setting.ServiceEnvs = append(setting.ServiceEnvs, env)
+	case "stable-name":
+		switch mode := container.StableNameMode(args); mode {
+		case container.StableNameRename, container.StableNameAlias:
+			setting.StableName = mode
+		case "off", "false":
+			setting.StableName = container.StableNameOff
 		default:
-			if action != "" {
-				setting.ContainerArgs = append(setting.ContainerArgs, "--"+action)
-				if args != "" {
-					setting.ContainerArgs = append(setting.ContainerArgs, args)
-				}
+			return errors.New(fmt.Sprintf("Failed to parse `stable-name` on %s, must be rename, alias or off", d.Line.Pos()))
+		}
+	case "ready-timeout", "drain-delay":
+		duration, err := time.ParseDuration(args)
+		if err != nil || duration < 0 {
+			return errors.New(fmt.Sprintf("Failed to parse `%s` on %s, must be a duration, eg. 30s", action, d.Line.Pos()))
+		}
+		if action == "ready-timeout" {
+			setting.ReadyTimeout = duration
+		} else {
+			setting.DrainDelay = duration
+		}
+	default:
+		if action != "" {
+			parsedArgs, err := splitRunArgs(d, args)
+			if err != nil {
+				return err
 			}
+			setting.ContainerArgs = append(setting.ContainerArgs, "--"+action)
+			setting.ContainerArgs = append(setting.ContainerArgs, parsedArgs...)
 		}
+	}
+
+	return nil
+}
 
-		cmdsMap[contr] = setting
+// Check the template expressions in a directive's value
+func checkDirectiveTemplate(d directive, arg string) error {
+	if err := container.CheckTemplate(arg); err != nil {
+		return errors.New(fmt.Sprintf("Failed to parse `%s` on %s, %s", d.Action, d.Line.Pos(), err))
 	}
+	return nil
+}
 
-	var containersState map[string]*helpers.ServiceState
-	if containersState, err = helpers.GetProjectState(projSettings.ProjectName, projSettings.ProjectSeparator); err != nil {
-		return
+// Split a directive's value into run arguments, quoted as in a shell
+func splitRunArgs(d directive, args string) ([]string, error) {
+	parsedArgs, err := helpers.SplitArgs(args)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to parse `%s` on %s, %s", d.Action, d.Line.Pos(), err))
 	}
-	// Post process
-	err = f.postProcessConfig(cmdsMap, projSettings, containersState)
-	return
+	for _, arg := range parsedArgs {
+		if err := checkRunArg(d, arg); err != nil {
+			return nil, err
+		}
+	}
+	return parsedArgs, nil
+}
 
+// Check a run argument, which unlike hooks isn't run through a shell
+func checkRunArg(d directive, arg string) error {
+	if strings.Contains(arg, "$CAPITAN_") {
+		logger.Warning.Printf("%s: $CAPITAN_ variables are no longer expanded in run arguments, use a template instead, eg. {{.Name}}\n", d.Line.Pos())
+	}
+	return checkDirectiveTemplate(d, arg)
 }
 
 // Now that we have all settings do some house keeping and processing
-func (f *ConfigParser) postProcessConfig(parsedConfig map[string]container.Container, projSettings *ProjectConfig, state map[string]*helpers.ServiceState) error {
+func (f *ConfigParser) postProcessConfig(raw *rawConfig, projSettings *ProjectConfig, state map[string]*helpers.ServiceState) error {
+
+	parsedConfig, instanceConfig, err := f.expandServices(raw)
+	if err != nil {
+		return err
+	}
 
 	// TODO duplicate containers for scaling
 	projSettings.ContainerList = make(SettingsList, 0)
+	projSettings.ServiceList = make(SettingsList, 0)
 
-	for name, item := range parsedConfig {
-		if f.Filter != "" && f.Filter != name {
-			continue
-		}
+	projSettings.ContainersState = make([]*helpers.ServiceState, 0, len(state))
+	for _, existing := range state {
+		projSettings.ContainersState = append(projSettings.ContainersState, existing)
+	}
+	sort.Slice(projSettings.ContainersState, func(i, j int) bool {
+		return projSettings.ContainersState[i].Name < projSettings.ContainersState[j].Name
+	})
 
+	for name, item := range parsedConfig {
 		if ! item.Enabled {
 			continue
 		}
 
-		item.Name = projSettings.ProjectName + projSettings.ProjectSeparator + name
-		item.ServiceType = name
-		item.ProjectName = projSettings.ProjectName
-		item.ProjectNameSeparator = projSettings.ProjectSeparator
+		f.processNames(name, projSettings, &item)
 
-		// default image to name if 'build' is set
-		if item.Build != "" {
-			item.Image = item.Name
+		if err := f.processService(projSettings, parsedConfig, state, &item); err != nil {
+			return err
 		}
+		service := item
+		projSettings.ServiceList = append(projSettings.ServiceList, &service)
 
-		f.processBlueGreenMode(projSettings.BlueGreenMode, &item)
+		if !f.inActiveProfile(&item) || !f.Filter.MatchService(&item) {
+			continue
+		}
 
 		f.processScaleArg(&item)
 
 		f.processCleanupTasks(projSettings, &item)
 
-		// resolve links
-		f.processLinks(parsedConfig, &item)
-
-		// resolve volumes from
-		f.processVolumesFrom(parsedConfig, &item)
+		// instances with their own overrides
+		overrides := make(map[int]*container.Container)
+		for num, override := range instanceConfig[name] {
+			if num > item.Scale {
+				logger.Warning.Printf("%s#%d is ignored, %s is scaled to %d\n", name, num, name, item.Scale)
+				continue
+			}
+			override := override
+			f.processNames(name, projSettings, &override)
+			if err := f.processService(projSettings, parsedConfig, state, &override); err != nil {
+				return err
+			}
+			override.Scale = item.Scale
+			overrides[num] = &override
+		}
 
-		ctrsToAdd := f.scaleContainers(&item, state)
+		ctrsToAdd := SettingsList(f.scaleContainers(&item, overrides, state)).Filter(f.Filter.Match)
 
 
 		projSettings.ContainerList = append(projSettings.ContainerList, ctrsToAdd...)
 	}
 
+	if err := f.processServiceEnvs(projSettings, parsedConfig, state); err != nil {
+		return err
+	}
+
+	return f.processOrphans(parsedConfig, projSettings)
+}
+
+// Name a service's definition
+func (f *ConfigParser) processNames(name string, projSettings *ProjectConfig, item *container.Container) {
+	item.Name = projSettings.ProjectName + projSettings.ProjectSeparator + name
+	item.ServiceType = name
+	item.ProjectName = projSettings.ProjectName
+	item.ProjectNameSeparator = projSettings.ProjectSeparator
+	item.NameTemplate = projSettings.NameTemplate
+	item.Network = projSettings.Network
+	if projSettings.Proxy != nil || projSettings.Discovery != nil {
+		item.Cutover = projSettings.cutover
+	}
+}
+
+// Fill in defaults and resolve what a service's definition refers to
+func (f *ConfigParser) processService(projSettings *ProjectConfig, parsedConfig map[string]container.Container, state map[string]*helpers.ServiceState, item *container.Container) error {
+	// default image to name if 'build' is set
+	if item.Build != "" {
+		item.Image = item.Name
+	}
+
+	f.processBlueGreenMode(projSettings.BlueGreenMode, item)
+
+	// both colours exist during a deploy
+	if item.BlueGreenMode == container.BGModeOn && !item.NameTemplate.HasColor() {
+		return errors.New(fmt.Sprintf("%s uses blue/green deploys but `name_template` %s gives both colours the same name, add {{.Color}}", item.ServiceType, item.NameTemplate.Text))
+	}
+	// docker only has aliases on user defined networks
+	if item.BlueGreenMode == container.BGModeOn && item.StableName == container.StableNameAlias && !item.HasUserNetwork() {
+		return errors.New(fmt.Sprintf("%s uses `stable-name alias` but isn't on a user defined network, set `global network` or give it one with `net`", item.ServiceType))
+	}
+
+	// record declared dependencies
+	f.processDependsOn(parsedConfig, item)
+
+	for _, env := range item.ServiceEnvs {
+		item.Dependencies = append(item.Dependencies, container.Dependency{
+			Service: env.Service,
+			Kind:    container.ServiceEnvDependency,
+			Alias:   env.Var,
+		})
+	}
+
+	// resolve links
+	f.processLinks(projSettings, parsedConfig, state, item)
 
+	// resolve volumes from
+	f.processVolumesFrom(projSettings, parsedConfig, state, item)
 	return nil
 }
 
+// The name of an instance of a service in the config, in its current colour
+func (f *ConfigParser) instanceName(projSettings *ProjectConfig, parsedConfig map[string]container.Container, svcType string, instance int, state map[string]*helpers.ServiceState) string {
+	target := parsedConfig[svcType]
+	f.processNames(svcType, projSettings, &target)
+	f.processBlueGreenMode(projSettings.BlueGreenMode, &target)
+	target.ServiceName = target.Name
+	target.InstanceNumber = instance
+	target.State = &helpers.ServiceState{Color: "blue"}
+	if existing, found := state[target.ServiceName+target.ProjectNameSeparator+strconv.Itoa(instance)]; found {
+		target.State = existing
+	}
+	target.NewName()
+	return target.Name
+}
+
 func (f *ConfigParser) processBlueGreenMode(globalBGMode bool, item *container.Container) {
 	if item.BlueGreenMode == container.BGModeUnknown {
 		if globalBGMode {
@@ -306,29 +929,102 @@ func (f *ConfigParser) processBlueGreenMode(globalBGMode bool, item *container.C
 }
 
 // Parse the volumes-from args and try and find first container with that type
-func (f *ConfigParser) processVolumesFrom(parsedConfig map[string]container.Container, item *container.Container) {
+func (f *ConfigParser) processVolumesFrom(projSettings *ProjectConfig, parsedConfig map[string]container.Container, state map[string]*helpers.ServiceState, item *container.Container) {
 	for i, ctrName := range item.VolumesFrom {
+		_, found := parsedConfig[ctrName]
+		item.Dependencies = append(item.Dependencies, container.Dependency{
+			Service:  ctrName,
+			Kind:     container.VolumesFromDependency,
+			External: !found,
+		})
 		// TODO Not sure how to do this for scaling
-		if _, found := parsedConfig[ctrName]; found {
-			ctrName = item.ProjectName + item.ProjectNameSeparator + ctrName + item.ProjectNameSeparator + "1"
+		if found {
+			ctrName = f.instanceName(projSettings, parsedConfig, ctrName, 1, state)
 			item.VolumesFrom[i] = ctrName
 		}
 	}
 }
 
 // Parse the link args and try and find first container with that type
-func (f *ConfigParser) processLinks(parsedConfig map[string]container.Container, item *container.Container) {
+func (f *ConfigParser) processLinks(projSettings *ProjectConfig, parsedConfig map[string]container.Container, state map[string]*helpers.ServiceState, item *container.Container) {
 	for i, link := range item.Links {
+		_, found := parsedConfig[link.Container]
+		item.Dependencies = append(item.Dependencies, container.Dependency{
+			Service:  link.Container,
+			Kind:     container.LinkDependency,
+			Alias:    link.Alias,
+			External: !found,
+		})
 		// TODO right now, for scaling links are bad so just putting it to first container
 		container := link.Container
-		if _, found := parsedConfig[link.Container]; found {
-			container = item.ProjectName + item.ProjectNameSeparator + link.Container + item.ProjectNameSeparator + "1"
+		if found {
+			container = f.instanceName(projSettings, parsedConfig, link.Container, 1, state)
 		}
 		link.Container = container
 		item.Links[i] = link
 	}
 }
 
+// Commands which run containers, and so need the addresses from `env-from-service`
+var runCommands = []string{"up", "create", "scale"}
+
+// Point each `env-from-service` at the first instance of its service,
+// the one being run by this command if there is one. Otherwise it must already be running.
+func (f *ConfigParser) processServiceEnvs(projSettings *ProjectConfig, parsedConfig map[string]container.Container, state map[string]*helpers.ServiceState) error {
+	first := make(map[string]*container.Container)
+	for _, set := range projSettings.ContainerList {
+		if set.InstanceNumber == 1 {
+			first[set.ServiceType] = set
+		}
+	}
+	runs := helpers.StringInSlice(f.Args.Get(0), runCommands)
+	for _, set := range projSettings.ContainerList {
+		envs := make([]container.ServiceEnv, len(set.ServiceEnvs))
+		for i, env := range set.ServiceEnvs {
+			if target, found := first[env.Service]; found {
+				env.Target = target
+			} else {
+				env.TargetName = f.instanceName(projSettings, parsedConfig, env.Service, 1, state)
+				existing, found := state[projSettings.ProjectName+projSettings.ProjectSeparator+env.Service+projSettings.ProjectSeparator+"1"]
+				if runs && (!found || !existing.Running) {
+					return errors.New(fmt.Sprintf("%s sets %s from %s, which isn't running and isn't run by this command (disabled, left out by profile or --filter)", set.ServiceType, env.Var, env.Service))
+				}
+			}
+			envs[i] = env
+		}
+		set.ServiceEnvs = envs
+	}
+	return nil
+}
+
+// Record the services declared with `depends-on`
+func (f *ConfigParser) processDependsOn(parsedConfig map[string]container.Container, item *container.Container) {
+	for _, svc := range item.DependsOn {
+		_, found := parsedConfig[svc]
+		if !found {
+			logger.Warning.Printf("%s depends on %s which isn't in the config\n", item.ServiceType, svc)
+		}
+		item.Dependencies = append(item.Dependencies, container.Dependency{
+			Service:  svc,
+			Kind:     container.DependsOnDependency,
+			External: !found,
+		})
+	}
+}
+
+// Whether the service has no profile or is in one of the active ones
+func (f *ConfigParser) inActiveProfile(item *container.Container) bool {
+	if len(item.Profiles) == 0 {
+		return true
+	}
+	for _, profile := range item.Profiles {
+		if helpers.StringInSlice(profile, f.Profiles) {
+			return true
+		}
+	}
+	return false
+}
+
 // Parse the scale argument and set the container's scale property
 func (f *ConfigParser) processScaleArg(ctr *container.Container) {
 	if f.Args.Get(0) == "scale" {
@@ -346,26 +1042,85 @@ func (f *ConfigParser) processScaleArg(ctr *container.Container) {
 func (f *ConfigParser) processCleanupTasks(projSettings *ProjectConfig, ctr *container.Container) {
 	var tasks SettingsList
 	for _, existing := range projSettings.ContainersState {
-		instNum, err := helpers.GetNumericSuffix(existing.Name, ctr.ProjectNameSeparator)
-		if err != nil || instNum < 0 || instNum > ctr.Scale {
+		if existing.ServiceName != ctr.Name {
+			continue
+		}
+		if existing.InstanceNum < 1 || existing.InstanceNum > ctr.Scale {
 			tempCtr := new(container.Container)
 			*tempCtr = *ctr
 			tempCtr.Name = existing.Name
+			tempCtr.InstanceNumber = existing.InstanceNum
+			tempCtr.State = existing
 			tasks = append(tasks, tempCtr)
 		}
 	}
+	tasks = tasks.Filter(f.Filter.Match)
 	projSettings.ContainerCleanupList = append(projSettings.ContainerCleanupList, tasks...)
 	return
 }
 
+// Find containers in the project whose service is no longer in the config (or is disabled).
+// These are only reported, never cleaned up automatically.
+func (f *ConfigParser) processOrphans(parsedConfig map[string]container.Container, projSettings *ProjectConfig) error {
+	orphans := make(SettingsList, 0)
+	prefix := projSettings.ProjectName + projSettings.ProjectSeparator
+	for _, existing := range projSettings.ContainersState {
+		svcType := strings.TrimPrefix(existing.ServiceName, prefix)
+		// services left out by profile still own their containers
+		if item, found := parsedConfig[svcType]; found && item.Enabled {
+			continue
+		}
+		orphans = append(orphans, &container.Container{
+			Name:                 existing.Name,
+			ServiceName:          existing.ServiceName,
+			ServiceType:          svcType,
+			Placement:            len(parsedConfig),
+			ProjectName:          projSettings.ProjectName,
+			ProjectNameSeparator: projSettings.ProjectSeparator,
+			InstanceNumber:       existing.InstanceNum,
+			Hooks:                make(container.Hooks),
+			State:                existing,
+		})
+	}
+
+	// there's no config to take an orphan's labels from, ask docker
+	if f.Filter.usesLabels() && len(orphans) > 0 {
+		names := make([]string, len(orphans))
+		for i, orphan := range orphans {
+			names[i] = orphan.Name
+		}
+		inspected, err := helpers.InspectContainers(names)
+		if err != nil {
+			return err
+		}
+		labels := make(map[string]map[string]string, len(inspected))
+		for _, ctr := range inspected {
+			labels[strings.TrimPrefix(ctr.Name, "/")] = ctr.Config.Labels
+		}
+		for _, orphan := range orphans {
+			orphan.State.Labels = labels[orphan.Name]
+			if orphan.State.Labels == nil {
+				orphan.State.Labels = make(map[string]string)
+			}
+		}
+	}
+
+	projSettings.OrphanList = orphans.Filter(f.Filter.Match)
+	return nil
+}
+
 // Create copies of containers which need to scale
-func (f *ConfigParser) scaleContainers(ctr *container.Container, state map[string]*helpers.ServiceState) []*container.Container {
+func (f *ConfigParser) scaleContainers(ctr *container.Container, overrides map[int]*container.Container, state map[string]*helpers.ServiceState) []*container.Container {
 
 	ctrCopies := make([]*container.Container, ctr.Scale)
 
 	for i := 0; i < ctr.Scale; i++ {
 		ctrCopies[i] = new(container.Container)
-		*ctrCopies[i] = *ctr
+		if override, found := overrides[i+1]; found {
+			*ctrCopies[i] = *override
+		} else {
+			*ctrCopies[i] = *ctr
+		}
 		ctrCopies[i].InstanceNumber = i + 1
 
 		var found bool
@@ -389,6 +1144,16 @@ func (f *ConfigParser) scaleContainers(ctr *container.Container, state map[strin
 	return ctrCopies
 }
 
+const defaultProjectSeparator = "_"
+
+// The project name used when not set in config, based on the current directory
+func defaultProjectName() string {
+	projName, _ := os.Getwd()
+	projName = toSnake(path.Base(projName))
+	projNameArr := strings.Split(projName, "_")
+	return projNameArr[len(projNameArr)-1]
+}
+
 func stripChars(str, chr string) string {
 	return strings.Map(func(r rune) rune {
 		if strings.IndexRune(chr, r) < 0 {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeDirectives(t *testing.T) {
+	d := func(action string, args string) directive {
+		return directive{Action: action, Args: args}
+	}
+	tests := []struct {
+		name      string
+		inherited []directive
+		own       []directive
+		want      []directive
+	}{
+		{
+			name:      "nothing own",
+			inherited: []directive{d("image", "redis"), d("env", "A=1")},
+			want:      []directive{d("image", "redis"), d("env", "A=1")},
+		},
+		{
+			name:      "scalar overridden",
+			inherited: []directive{d("image", "redis"), d("command", "serve")},
+			own:       []directive{d("image", "redis:5")},
+			want:      []directive{d("command", "serve"), d("image", "redis:5")},
+		},
+		{
+			name:      "others appended",
+			inherited: []directive{d("env", "A=1"), d("publish", "80:80"), d("profile", "dev")},
+			own:       []directive{d("env", "B=2"), d("profile", "test")},
+			want:      []directive{d("env", "A=1"), d("publish", "80:80"), d("profile", "dev"), d("env", "B=2"), d("profile", "test")},
+		},
+		{
+			name:      "every inherited scalar of an action dropped",
+			inherited: []directive{d("scale", "1"), d("env", "A=1"), d("scale", "2")},
+			own:       []directive{d("scale", "3")},
+			want:      []directive{d("env", "A=1"), d("scale", "3")},
+		},
+	}
+	for _, test := range tests {
+		got := mergeDirectives(test.inherited, test.own)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOrderByServiceEnvs(t *testing.T) {
+	envsFrom := func(services ...string) container.Container {
+		var ctr container.Container
+		for _, service := range services {
+			ctr.ServiceEnvs = append(ctr.ServiceEnvs, container.ServiceEnv{Var: "ADDR", Service: service})
+		}
+		return ctr
+	}
+	tests := []struct {
+		name      string
+		order     []string
+		services  map[string]container.Container
+		instances map[string]map[int]container.Container
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:     "config order kept",
+			order:    []string{"web", "db"},
+			services: map[string]container.Container{"web": envsFrom(), "db": envsFrom()},
+			want:     []string{"web", "db"},
+		},
+		{
+			name:     "target moved first",
+			order:    []string{"web", "cache", "db"},
+			services: map[string]container.Container{"web": envsFrom("db"), "cache": envsFrom(), "db": envsFrom()},
+			want:     []string{"db", "web", "cache"},
+		},
+		{
+			name:     "chain",
+			order:    []string{"a", "b", "c"},
+			services: map[string]container.Container{"a": envsFrom("b"), "b": envsFrom("c"), "c": envsFrom()},
+			want:     []string{"c", "b", "a"},
+		},
+		{
+			name:      "instance override",
+			order:     []string{"web", "db"},
+			services:  map[string]container.Container{"web": envsFrom(), "db": envsFrom()},
+			instances: map[string]map[int]container.Container{"web": {2: envsFrom("db")}},
+			want:      []string{"db", "web"},
+		},
+		{
+			name:     "circular",
+			order:    []string{"a", "b"},
+			services: map[string]container.Container{"a": envsFrom("b"), "b": envsFrom("a")},
+			wantErr:  true,
+		},
+		{
+			name:     "refers to itself",
+			order:    []string{"a"},
+			services: map[string]container.Container{"a": envsFrom("a")},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown service",
+			order:    []string{"web"},
+			services: map[string]container.Container{"web": envsFrom("db")},
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		got, err := orderByServiceEnvs(test.order, test.services, test.instances)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadConfigLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capitan-include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"common.cfg":      "global project shop\ninclude sub/db.cfg",
+		"sub/db.cfg":      "db image postgres\ninclude cache.cfg",
+		"sub/cache.cfg":   "cache image redis",
+		"loop-a.cfg":      "include loop-b.cfg",
+		"loop-b.cfg":      "app image app\ninclude loop-a.cfg",
+		"self.cfg":        "include self.cfg",
+		"args.cfg":        "include common.cfg",
+		"gen.sh":          "#!/bin/sh\necho \"gen image $1\"\necho \"gen env DIR=$(basename $(pwd))\"",
+		"sub/missing.cfg": "a image a\n\ninclude nothere.cfg",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(file, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rel := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "relative to the including file",
+			config: "web image nginx\ninclude common.cfg\nweb scale 2",
+			want: []string{
+				"main:1 web image nginx",
+				rel("common.cfg") + ":1 global project shop",
+				rel("sub/db.cfg") + ":1 db image postgres",
+				rel("sub/cache.cfg") + ":1 cache image redis",
+				"main:3 web scale 2",
+			},
+		},
+		{
+			name:   "executable run in its own directory",
+			config: "include gen.sh nginx",
+			want: []string{
+				rel("gen.sh") + ":1 gen image nginx",
+				rel("gen.sh") + ":2 gen env DIR=" + filepath.Base(dir),
+				rel("gen.sh") + ":3 ",
+			},
+		},
+		{
+			name:    "cycle",
+			config:  "include loop-a.cfg",
+			wantErr: "Failed to include `loop-a.cfg` on " + rel("loop-b.cfg") + ":2, it includes itself",
+		},
+		{
+			name:    "includes itself",
+			config:  "include self.cfg",
+			wantErr: "Failed to include `self.cfg` on " + rel("self.cfg") + ":1, it includes itself",
+		},
+		{
+			name:    "arguments to a plain file",
+			config:  "include args.cfg x",
+			wantErr: "Failed to include `args.cfg x` on main:1, arguments given but file is not executable",
+		},
+		{
+			name:    "position of a failing include",
+			config:  "include sub/missing.cfg",
+			wantErr: "Failed to include `nothere.cfg` on " + rel("sub/missing.cfg") + ":3",
+		},
+	}
+	for _, test := range tests {
+		f := &ConfigParser{}
+		lines, err := f.readConfigLines([]byte(test.config), "main", dir, nil)
+		if test.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = line.Pos() + " " + string(line.Text)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -2,12 +2,10 @@ package container
 
 import (
 	"errors"
-	"fmt"
 	. "github.com/byrnedo/capitan/consts"
 	"github.com/byrnedo/capitan/helpers"
 	"github.com/byrnedo/capitan/logger"
 	. "github.com/byrnedo/capitan/logger"
-	"github.com/codeskyblue/go-sh"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -48,6 +46,26 @@ type Link struct {
 	Alias     string
 }
 
+type DependencyKind string
+
+const (
+	DependsOnDependency   DependencyKind = "depends-on"
+	LinkDependency        DependencyKind = "link"
+	VolumesFromDependency DependencyKind = "volumes-from"
+	ServiceEnvDependency  DependencyKind = "env-from-service"
+)
+
+// A reference from one service to another
+type Dependency struct {
+	// the service type depended on, or the raw container name if not in the config
+	Service string
+	Kind    DependencyKind
+	// link alias, or the variable set with `env-from-service`
+	Alias string
+	// not a service in the config
+	External bool
+}
+
 type AppliedAction string
 
 const (
@@ -113,6 +131,18 @@ const (
 	BGModeUnknown
 )
 
+// How the live container of a blue/green service keeps a fixed name
+type StableNameMode string
+
+const (
+	// the name changes colour with each deploy
+	StableNameOff StableNameMode = ""
+	// renamed to the canonical name after cutover
+	StableNameRename StableNameMode = "rename"
+	// the canonical name is a network alias
+	StableNameAlias StableNameMode = "alias"
+)
+
 type Container struct {
 	// Container name
 	Name string
@@ -136,6 +166,14 @@ type Container struct {
 	Links []Link
 	// volumes from list
 	VolumesFrom []string
+	// services declared with `depends-on`
+	DependsOn []string
+	// environment variables set to other services' addresses
+	ServiceEnvs []ServiceEnv
+	// profiles the service belongs to, a service without any is always included
+	Profiles []string
+	// every service this one refers to, filled in after parsing
+	Dependencies []Dependency
 	// hooks map for this definition
 	Hooks Hooks
 	// used in commands
@@ -158,10 +196,138 @@ type Container struct {
 	Enabled bool
 	// The current state of the container
 	State *helpers.ServiceState
+	// how container names are built, the default if nil
+	NameTemplate *helpers.NameTemplate
+	// keep a fixed name for blue/green deploys
+	StableName StableNameMode
+	// the project network, joined with the service as an alias
+	Network string
+	// how long a blue/green deploy waits for the new container to be ready
+	ReadyTimeout time.Duration
+	// how long the old container keeps running after leaving the network
+	DrainDelay time.Duration
+	// called during a blue/green deploy once the new container is ready, before the old one is stopped
+	Cutover func(old *Container) error
 }
 
+func (set *Container) nameFields() helpers.NameFields {
+	return helpers.NameFields{
+		Project:  set.ProjectName,
+		Service:  set.ServiceType,
+		Color:    set.State.Color,
+		Instance: set.InstanceNumber,
+		Sep:      set.ProjectNameSeparator,
+	}
+}
+
+// Name the container for its colour and instance.
+// The live container of a service with `stable-name rename` has the canonical name instead.
 func (set *Container) NewName() {
-	set.Name = fmt.Sprintf("%s%s%s%s%d", set.ServiceName, set.ProjectNameSeparator, set.State.Color, set.ProjectNameSeparator, set.InstanceNumber)
+	if set.hasStableName(StableNameRename) {
+		set.Name = set.CanonicalName()
+		return
+	}
+	set.Name = set.colorName()
+}
+
+func (set *Container) colorName() string {
+	return set.names().Name(set.nameFields())
+}
+
+func (set *Container) names() *helpers.NameTemplate {
+	if set.NameTemplate == nil {
+		return helpers.DefaultNames
+	}
+	return set.NameTemplate
+}
+
+// The name which doesn't change between blue/green deploys, eg. myproj_app_1
+func (set *Container) CanonicalName() string {
+	return set.names().ColorlessName(set.nameFields())
+}
+
+// Network aliases for docker run. They're left out of the args hash so turning
+// `stable-name alias` on doesn't recreate every container.
+// Docker only allows them on user defined networks, otherwise they're added by JoinNetwork.
+func (set *Container) aliasArgs() []interface{} {
+	if !set.runsOnUserNetwork() {
+		return nil
+	}
+	var args []interface{}
+	if set.hasStableName(StableNameAlias) {
+		args = append(args, "--network-alias", set.CanonicalName())
+	}
+	// docker run joins the project network itself, see JoinNetwork
+	if set.Network != "" && set.netArg() == set.Network {
+		args = append(args, "--network-alias", set.ServiceType)
+	}
+	return args
+}
+
+func (set *Container) hasStableName(mode StableNameMode) bool {
+	return set.BlueGreenMode == BGModeOn && set.StableName == mode
+}
+
+// The network the service picks with `net`, if it does
+func (set *Container) netArg() string {
+	var network string
+	for i := 0; i < len(set.ContainerArgs)-1; i++ {
+		if set.ContainerArgs[i] == "--net" || set.ContainerArgs[i] == "--network" {
+			i++
+			network = set.ContainerArgs[i]
+		}
+	}
+	return network
+}
+
+// Whether docker run attaches the container to a user defined network
+func (set *Container) runsOnUserNetwork() bool {
+	switch network := set.netArg(); {
+	case network == "", network == "default", network == "bridge", network == "host", network == "none", strings.HasPrefix(network, "container:"):
+		return false
+	}
+	return true
+}
+
+// Whether the project network is joined after docker run.
+// A service which picks its own with `net` is left alone: host, none and container:x
+// can't join another and the same network was joined by docker run.
+func (set *Container) joinsNetwork() bool {
+	if set.Network == "" {
+		return false
+	}
+	switch network := set.netArg(); {
+	case network == "host", network == "none", strings.HasPrefix(network, "container:"), network == set.Network:
+		return false
+	}
+	return true
+}
+
+// Whether the container ends up on a user defined network, the only kind with aliases
+func (set *Container) HasUserNetwork() bool {
+	return set.runsOnUserNetwork() || set.joinsNetwork()
+}
+
+// Join the project network, where the service name resolves to this container
+func (set *Container) JoinNetwork() error {
+	if !set.joinsNetwork() {
+		return nil
+	}
+	if err := helpers.EnsureNetwork(set.Network); err != nil {
+		return err
+	}
+	ctr, err := helpers.InspectContainer(set.Name)
+	if err != nil {
+		return err
+	}
+	if _, found := ctr.NetworkSettings.Networks[set.Network]; found {
+		return nil
+	}
+	aliases := []string{set.ServiceType}
+	if set.hasStableName(StableNameAlias) {
+		aliases = append(aliases, set.CanonicalName())
+	}
+	return helpers.ConnectNetwork(set.Network, set.Name, aliases...)
 }
 
 // Builds an image for a container
@@ -187,7 +353,7 @@ func (set *Container) BuildImage() error {
 
 func (set *Container) launchWithRmInForeground(cmd []interface{}) error {
 	var (
-		ses *shellsession.ShellSession
+		ses *loggedSession
 		err error
 	)
 
@@ -216,7 +382,7 @@ func (set *Container) launchWithRmInForeground(cmd []interface{}) error {
 func (set *Container) launchInForeground(cmd []interface{}, wg *sync.WaitGroup) error {
 
 	var (
-		ses *shellsession.ShellSession
+		ses *loggedSession
 		err error
 	)
 
@@ -273,8 +439,14 @@ func (set *Container) BlueGreenCopy() (newCon *Container) {
 
 	newCon = new(Container)
 	*newCon = *set
+	// the copy gets its own state, the original's is still needed to remove it
+	newState := *set.State
+	newState.Running = false
+	newCon.State = &newState
 	newCon.State.Color = newColor
-	newCon.NewName()
+	// the canonical name is taken until the old one is removed
+	newCon.Name = newCon.colorName()
+	newCon.State.Name = newCon.Name
 	return
 
 
@@ -284,11 +456,51 @@ func (set *Container) BlueGreenDeploy(attach bool, dryRun bool, wg *sync.WaitGro
 
 	newCon := set.BlueGreenCopy()
 
+	// roll back to the old, it hasn't been touched yet
+	rollback := func(err error) error {
+		Warning.Println("Error running new container, removing...")
+		if !dryRun {
+			if rmErr := newCon.Rm([]string{"-f"}); rmErr != nil {
+				Warning.Println("Failed to remove new container "+newCon.Name+":", rmErr)
+			}
+		}
+		return err
+	}
+
+	// the new container joins the network when it's run
 	if err := newCon.Run(attach, dryRun, wg); err != nil {
-		// put back the old
-		Warning.Println("Error running new container, killing...")
-		newCon.Kill(nil)
-		return  err
+		return rollback(err)
+	}
+
+	if !newCon.Remove {
+		ContainerInfoLog(newCon.Name, "Waiting until ready...")
+		if !dryRun {
+			if err := helpers.WaitUntilReady(newCon.Name, newCon.ReadyTimeout, 500*time.Millisecond); err != nil {
+				return rollback(err)
+			}
+		}
+	}
+
+	if set.Cutover != nil && !dryRun {
+		if err := set.Cutover(set); err != nil {
+			return rollback(err)
+		}
+	}
+
+	// move clients over to the new container before the old one stops
+	if set.Network != "" && set.State.Running {
+		ContainerInfoLog(set.Name, "Leaving network "+set.Network+"...")
+		if !dryRun {
+			if err := helpers.DisconnectNetwork(set.Network, set.Name); err != nil {
+				Warning.Println("Failed to disconnect "+set.Name+" from "+set.Network+":", err)
+			}
+		}
+	}
+	if set.DrainDelay > 0 && set.State.Running {
+		ContainerInfoLog(set.Name, "Draining for "+set.DrainDelay.String()+"...")
+		if !dryRun {
+			time.Sleep(set.DrainDelay)
+		}
 	}
 
 	// shutdown the old
@@ -300,6 +512,22 @@ func (set *Container) BlueGreenDeploy(attach bool, dryRun bool, wg *sync.WaitGro
 		}
 	}
 
+	if set.hasStableName(StableNameRename) {
+		canonical := set.CanonicalName()
+		ContainerInfoLog(newCon.Name, "Renaming to "+canonical+"...")
+		if !dryRun {
+			if err := helpers.RenameContainer(newCon.Name, canonical); err != nil {
+				return err
+			}
+		}
+		newCon.Name = canonical
+		newCon.State.Name = canonical
+	}
+
+	// from here on this definition refers to the new container
+	set.Name = newCon.Name
+	set.State = newCon.State
+
 	return nil
 }
 
@@ -314,10 +542,60 @@ func (set *Container) RecreateAndRun(attach bool, dryRun bool, wg *sync.WaitGrou
 	return nil
 }
 
+// Hash of the run arguments, stored in a label to tell when the config has changed.
+// The name is left out so renamed containers, eg. by `capitan migrate`, aren't recreated.
+func ArgsHash(args []interface{}) string {
+	if len(args) > 1 && args[0] == "--name" {
+		args = args[2:]
+	}
+	return helpers.HashInterfaceSlice(args)
+}
+
+// Whether a container created with this args hash is up to date with the config.
+// Hashes used to include the name, those are checked with each name the
+// container could have been created under.
+func (set *Container) ArgsUpToDate(hash string) bool {
+	if set.State != nil && set.State.Adopted {
+		// no hash to compare, its config was generated from it
+		return true
+	}
+	args, err := set.HashArguments()
+	if err != nil {
+		// can't be run as it is, running it reports why
+		return false
+	}
+	if hash == ArgsHash(args) {
+		return true
+	}
+	fields := helpers.NameFields{
+		Project:  set.ProjectName,
+		Service:  set.ServiceType,
+		Color:    set.State.Color,
+		Instance: set.InstanceNumber,
+		Sep:      set.ProjectNameSeparator,
+	}
+	names := []string{
+		set.Name,
+		set.State.Name,
+		helpers.DefaultNames.Name(fields),
+		helpers.LegacyNames.Name(fields),
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		args[1] = name
+		if hash == helpers.HashInterfaceSlice(args) {
+			return true
+		}
+	}
+	return false
+}
+
 func createCapitanContainerLabels(ctr *Container, args []interface{}) []interface{} {
 	return []interface{}{
 		"--label",
-		UniqueLabelName + "=" + helpers.HashInterfaceSlice(args),
+		UniqueLabelName + "=" + ArgsHash(args),
 		"--label",
 		ServiceLabelName + "=" + ctr.ServiceName,
 		"--label",
@@ -342,15 +620,26 @@ func (set *Container) Create(dryRun bool) error {
 	if err := set.Hooks.Run("before.create", set); err != nil {
 		return err
 	}
+	set.ResolveServiceEnvs()
 
-	cmd := set.GetRunArguments()
-	labels := createCapitanContainerLabels(set, cmd)
-	cmd = append(labels, cmd...)
+	cmd, err := set.GetRunArguments()
+	if err != nil {
+		return err
+	}
+	hashArgs, err := set.HashArguments()
+	if err != nil {
+		return err
+	}
+	labels := createCapitanContainerLabels(set, hashArgs)
+	cmd = append(append(labels, set.aliasArgs()...), cmd...)
 
 	cmd = append([]interface{}{"create"}, cmd...)
 	if err := set.launchDaemonCommand(cmd); err != nil {
 		return err
 	}
+	if err := set.JoinNetwork(); err != nil {
+		return err
+	}
 
 	return set.Hooks.Run("after.create", set)
 }
@@ -366,10 +655,18 @@ func (set *Container) Run(attach bool, dryRun bool, wg *sync.WaitGroup) error {
 	if err := set.Hooks.Run("before.run", set); err != nil {
 		return err
 	}
+	set.ResolveServiceEnvs()
 
-	cmd := set.GetRunArguments()
-	labels := createCapitanContainerLabels(set, cmd)
-	cmd = append(labels, cmd...)
+	cmd, err := set.GetRunArguments()
+	if err != nil {
+		return err
+	}
+	hashArgs, err := set.HashArguments()
+	if err != nil {
+		return err
+	}
+	labels := createCapitanContainerLabels(set, hashArgs)
+	cmd = append(append(labels, set.aliasArgs()...), cmd...)
 
 	if set.Remove {
 		if err := set.launchWithRmInForeground(cmd); err != nil {
@@ -385,6 +682,13 @@ func (set *Container) Run(attach bool, dryRun bool, wg *sync.WaitGroup) error {
 			return err
 		}
 	}
+	set.State.Running = !set.Remove
+
+	if !set.Remove {
+		if err := set.JoinNetwork(); err != nil {
+			return err
+		}
+	}
 
 	return set.Hooks.Run("after.run", set)
 }
@@ -396,36 +700,55 @@ func (set *Container) launchDaemonCommand(cmd []interface{}) error {
 	)
 	ses = NewContainerShellSession(set)
 
-	concStr := "docker "
-	for _, arg := range cmd {
-		concStr += fmt.Sprintf("%s", arg) + " "
-	}
-	concStr = strings.Trim(concStr, " ")
-
-	err = ses.Command("bash", "-c", concStr).Run()
+	// arguments are passed as they are, never through a shell
+	err = ses.Command("docker", cmd...).Run()
 	return err
 }
 
-func (set *Container) startLoggedCommand(cmd []interface{}) (*shellsession.ShellSession, error) {
-	ses := NewContainerShellSession(set)
+// A shell session whose output is prefixed with the container's name
+type loggedSession struct {
+	*shellsession.ShellSession
+	stdout *ContainerLogWriter
+	stderr *ContainerLogWriter
+}
 
-	color := nextColor()
-	ses.Stdout = NewContainerLogWriter(os.Stdout, set.Name, color)
-	ses.Stderr = NewContainerLogWriter(os.Stderr, set.Name, color)
+// Wait for the command to exit, printing any partial line left over
+func (l *loggedSession) Wait() error {
+	err := l.ShellSession.Wait()
+	l.stdout.Flush()
+	l.stderr.Flush()
+	return err
+}
 
-	concStr := "docker "
-	for _, arg := range cmd {
-		concStr += fmt.Sprintf("%s", arg) + " "
+func (set *Container) startLoggedCommand(cmd []interface{}) (*loggedSession, error) {
+	color := nextColor()
+	ses := &loggedSession{
+		ShellSession: NewContainerShellSession(set),
+		stdout:       NewContainerLogWriter(os.Stdout, set.Name, color),
+		stderr:       NewContainerLogWriter(os.Stderr, set.Name, color),
 	}
-	concStr = strings.Trim(concStr, " ")
+	ses.Stdout = ses.stdout
+	ses.Stderr = ses.stderr
 
-	err := ses.Command("bash", "-c", concStr).Start()
+	err := ses.Command("docker", cmd...).Start()
 
 	return ses, err
 }
 
-// Create docker arg slice from container options
-func (set *Container) GetRunArguments() []interface{} {
+// Create docker arg slice from container options.
+// Template expressions in the args, links, volumes from and command are expanded for this instance.
+// Services' addresses are those found by ResolveServiceEnvs, by the service's name until then.
+func (set *Container) GetRunArguments() ([]interface{}, error) {
+	return set.runArguments(false)
+}
+
+// The run arguments which are hashed, see ArgsHash. Services' addresses are always
+// by their names so the hash doesn't change with their ips, ServiceEnvsChanged checks those.
+func (set *Container) HashArguments() ([]interface{}, error) {
+	return set.runArguments(true)
+}
+
+func (set *Container) runArguments(forHash bool) ([]interface{}, error) {
 	imageName := set.Name
 	if len(set.Image) > 0 {
 		imageName = set.Image
@@ -437,26 +760,52 @@ func (set *Container) GetRunArguments() []interface{} {
 		if link.Alias != "" {
 			linkStr += ":" + link.Alias
 		}
-		linkArgs = append(linkArgs, "--link", linkStr)
+		expanded, err := set.expandAll([]string{linkStr})
+		if err != nil {
+			return nil, err
+		}
+		linkArgs = append(linkArgs, "--link")
+		linkArgs = append(linkArgs, expanded...)
 	}
 
 	var volumesFromArgs = make([]interface{}, 0, len(set.VolumesFrom)*2)
 	for _, vol := range set.VolumesFrom {
-		volumesFromArgs = append(volumesFromArgs, "--volumes-from", vol)
+		expanded, err := set.expandAll([]string{vol})
+		if err != nil {
+			return nil, err
+		}
+		volumesFromArgs = append(volumesFromArgs, "--volumes-from")
+		volumesFromArgs = append(volumesFromArgs, expanded...)
+	}
+
+	containerArgs, err := set.expandAll(set.ContainerArgs)
+	if err != nil {
+		return nil, err
+	}
+	command, err := set.expandAll(set.Command)
+	if err != nil {
+		return nil, err
 	}
 
-	cmd := append([]interface{}{"--name", set.Name}, helpers.ToInterfaceSlice(set.ContainerArgs)...)
+	cmd := append([]interface{}{"--name", set.Name}, containerArgs...)
+	for _, env := range set.ServiceEnvs {
+		addr := env.NamedAddress()
+		if env.Resolved && !forHash {
+			addr = env.Address
+		}
+		cmd = append(cmd, "--env", env.Var+"="+addr)
+	}
 	cmd = append(cmd, linkArgs...)
 	cmd = append(cmd, volumesFromArgs...)
 	cmd = append(cmd, imageName)
-	cmd = append(cmd, helpers.ToInterfaceSlice(set.Command)...)
-	return cmd
+	cmd = append(cmd, command...)
+	return cmd, nil
 }
 
 func (set *Container) Attach(wg *sync.WaitGroup) error {
 	var (
 		err error
-		ses *shellsession.ShellSession
+		ses *loggedSession
 	)
 	if ses, err = set.startLoggedCommand(append([]interface{}{"attach", "--sig-proxy=false"}, set.Name)); err != nil {
 		return err
@@ -494,6 +843,7 @@ func (set *Container) Start(attach bool, wg *sync.WaitGroup) error {
 	if err = set.launchDaemonCommand(append([]interface{}{"start"}, set.Name)); err != nil {
 		return err
 	}
+	set.State.Running = true
 	if attach {
 		if err = set.Attach(wg); err != nil {
 			return err
@@ -526,7 +876,7 @@ func (set *Container) Restart(args []string) error {
 // Returns a containers IP
 // TODO needs to respect scale
 func (set *Container) IPs() string {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{range $i, $p := .NetworkSettings.Networks}}{{$p.IPAddress}}@{{$i}},{{end}}", set.Name).Output()
 	if err != nil {
@@ -536,22 +886,63 @@ func (set *Container) IPs() string {
 	return ip
 }
 
-// Start streaming a container's logs
-// TODO needs to respect scale
-func (set *Container) Logs() (*sh.Session, error) {
+// Options for the 'logs' command, passed through to `docker logs`
+type LogOptions struct {
+	// show logs since timestamp or relative time, eg 42m
+	Since string
+	// show logs before timestamp or relative time
+	Until string
+	// number of lines to show from the end, or "all"
+	Tail string
+	// show timestamps
+	Timestamps bool
+	// keep streaming new output
+	Follow bool
+}
+
+func (opts LogOptions) args() []interface{} {
+	args := []interface{}{}
+	if opts.Since != "" {
+		args = append(args, "--since", opts.Since)
+	}
+	if opts.Until != "" {
+		args = append(args, "--until", opts.Until)
+	}
+	if opts.Tail != "" {
+		args = append(args, "--tail", opts.Tail)
+	}
+	if opts.Timestamps {
+		args = append(args, "--timestamps")
+	}
+	if opts.Follow {
+		args = append(args, "--follow")
+	}
+	return args
+}
+
+// Stream a container's logs, blocks until `docker logs` exits
+func (set *Container) Logs(opts LogOptions) error {
 	color := nextColor()
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 
 	if logger.GetLevel() == DebugLevel {
 		ses.ShowCMD = true
 	}
-	ses.Command("docker", "logs", "--tail", "10", "-f", set.Name)
+	args := append([]interface{}{"logs"}, opts.args()...)
+	ses.Command("docker", append(args, set.Name)...)
 
-	ses.Stdout = NewContainerLogWriter(os.Stdout, set.Name, color)
-	ses.Stderr = NewContainerLogWriter(os.Stderr, set.Name, color)
+	stdout := NewContainerLogWriter(os.Stdout, set.Name, color)
+	stderr := NewContainerLogWriter(os.Stderr, set.Name, color)
+	ses.Stdout = stdout
+	ses.Stderr = stderr
 
-	err := ses.Start()
-	return ses, err
+	if err := ses.Start(); err != nil {
+		return err
+	}
+	err := ses.Wait()
+	stdout.Flush()
+	stderr.Flush()
+	return err
 }
 
 // Kills the container
@@ -565,6 +956,7 @@ func (set *Container) Kill(args []string) error {
 	if _, err := helpers.RunCmd(append([]interface{}{"kill"}, helpers.ToInterfaceSlice(args)...)...); err != nil {
 		return err
 	}
+	set.State.Running = false
 	if err := set.Hooks.Run("after.kill", set); err != nil {
 		return err
 	}
@@ -583,6 +975,7 @@ func (set *Container) Stop(args []string) error {
 	if _, err := helpers.RunCmd(append([]interface{}{"stop"}, helpers.ToInterfaceSlice(args)...)...); err != nil {
 		return err
 	}
+	set.State.Running = false
 	if err := set.Hooks.Run("after.stop", set); err != nil {
 		return err
 	}
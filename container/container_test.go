@@ -0,0 +1,48 @@
+package container
+
+import (
+	"github.com/byrnedo/capitan/helpers"
+	"reflect"
+	"testing"
+)
+
+func TestAliasArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		network     string
+		args        []string
+		stable      StableNameMode
+		want        []interface{}
+		userNetwork bool
+	}{
+		{"default bridge", "", nil, StableNameAlias, nil, false},
+		{"bridge", "", []string{"--net", "bridge"}, StableNameAlias, nil, false},
+		{"host", "proj", []string{"--net", "host"}, StableNameAlias, nil, false},
+		{"own network", "", []string{"--net", "back"}, StableNameAlias, []interface{}{"--network-alias", "proj_app_1"}, true},
+		{"own network, no alias", "", []string{"--network", "back"}, StableNameRename, nil, true},
+		{"joins project network", "proj", nil, StableNameAlias, nil, true},
+		{
+			"runs on project network", "proj", []string{"--net", "proj"}, StableNameAlias,
+			[]interface{}{"--network-alias", "proj_app_1", "--network-alias", "app"}, true,
+		},
+	}
+	for _, test := range tests {
+		set := &Container{
+			ProjectName:          "proj",
+			ProjectNameSeparator: "_",
+			ServiceType:          "app",
+			InstanceNumber:       1,
+			BlueGreenMode:        BGModeOn,
+			StableName:           test.stable,
+			Network:              test.network,
+			ContainerArgs:        test.args,
+			State:                &helpers.ServiceState{Color: "green"},
+		}
+		if got := set.aliasArgs(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if got := set.HasUserNetwork(); got != test.userNetwork {
+			t.Errorf("%s: got user network %v, want %v", test.name, got, test.userNetwork)
+		}
+	}
+}
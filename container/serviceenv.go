@@ -0,0 +1,144 @@
+package container
+
+import (
+	"errors"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"net"
+	"sort"
+)
+
+// An environment variable set to another service's address, from `env-from-service`
+type ServiceEnv struct {
+	Var string
+	// the service type, eg. db
+	Service string
+	// container port, added to the address if given
+	Port string
+	// the service's first instance if this command runs it, so its name follows blue/green deploys
+	Target *Container
+	// the first instance's name otherwise
+	TargetName string
+	// found once when the container is run, see ResolveServiceEnvs
+	Address  string
+	Resolved bool
+}
+
+// The address by the service's name, eg. db:5432, as it is on the global network.
+// Used in the args hash, which mustn't change with the target's ip.
+func (env ServiceEnv) NamedAddress() string {
+	return joinHostPort(env.Service, env.Port)
+}
+
+func (env ServiceEnv) targetName() string {
+	if env.Target != nil {
+		return env.Target.Name
+	}
+	return env.TargetName
+}
+
+// The service's address as this container reaches it, eg. db:5432 or 172.18.0.3:5432
+func (set *Container) serviceAddress(env ServiceEnv) (string, error) {
+	// every colour answers to the service's name on the project network
+	if set.Network != "" {
+		return joinHostPort(env.Service, env.Port), nil
+	}
+
+	name := env.targetName()
+	target, err := helpers.InspectContainer(name)
+	if err != nil {
+		return "", err
+	}
+	if !target.State.Running {
+		return "", errors.New(name + " isn't running")
+	}
+
+	// through the host, on its port or the published one
+	if target.HostConfig.NetworkMode == "host" {
+		return joinHostPort("127.0.0.1", env.Port), nil
+	}
+	if helpers.StringInSlice("host", set.networks()) {
+		if env.Port == "" {
+			return "127.0.0.1", nil
+		}
+		for _, binding := range target.NetworkSettings.Ports[env.Port+"/tcp"] {
+			if binding.HostPort != "" {
+				return joinHostPort("127.0.0.1", binding.HostPort), nil
+			}
+		}
+		return "", errors.New("port " + env.Port + " of " + name + " isn't published")
+	}
+
+	// a network both are on, otherwise the target's first
+	for _, network := range set.networks() {
+		if settings, found := target.NetworkSettings.Networks[network]; found && settings.IPAddress != "" {
+			return joinHostPort(settings.IPAddress, env.Port), nil
+		}
+	}
+	var networks []string
+	for network, settings := range target.NetworkSettings.Networks {
+		if settings.IPAddress != "" {
+			networks = append(networks, network)
+		}
+	}
+	if len(networks) == 0 {
+		return "", errors.New(name + " has no ip address")
+	}
+	sort.Strings(networks)
+	return joinHostPort(target.NetworkSettings.Networks[networks[0]].IPAddress, env.Port), nil
+}
+
+// Find each service's address once, before the container is run.
+// Those which can't be found are left empty and warned about.
+func (set *Container) ResolveServiceEnvs() {
+	envs := make([]ServiceEnv, len(set.ServiceEnvs))
+	for i, env := range set.ServiceEnvs {
+		if !env.Resolved {
+			addr, err := set.serviceAddress(env)
+			if err != nil {
+				Warning.Printf("%s: no address for %s from %s, it's left empty: %s\n", set.Name, env.Var, env.Service, err)
+			}
+			env.Address, env.Resolved = addr, true
+		}
+		envs[i] = env
+	}
+	set.ServiceEnvs = envs
+}
+
+// Whether the container has different addresses than it would be given now,
+// eg. a service it takes one from was redeployed and has a new ip
+func (set *Container) ServiceEnvsChanged() (bool, error) {
+	if len(set.ServiceEnvs) == 0 {
+		return false, nil
+	}
+	set.ResolveServiceEnvs()
+	ctr, err := helpers.InspectContainer(set.Name)
+	if err != nil {
+		return false, err
+	}
+	for _, env := range set.ServiceEnvs {
+		if !helpers.StringInSlice(env.Var+"="+env.Address, ctr.Config.Env) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// The networks given with `net` or `network`
+func (set *Container) networks() []string {
+	var networks []string
+	for i := 0; i < len(set.ContainerArgs)-1; i++ {
+		if set.ContainerArgs[i] == "--net" || set.ContainerArgs[i] == "--network" {
+			networks = append(networks, set.ContainerArgs[i+1])
+			i++
+		}
+	}
+	return networks
+}
+
+func joinHostPort(host string, port string) string {
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
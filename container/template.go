@@ -0,0 +1,199 @@
+package container
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// The values available to templates in directive values,
+// eg. `env SELF={{.Name}}` or `publish 80{{.Instance}}:80`
+type TemplateData struct {
+	// container name, eg. myproj_app_blue_2
+	Name string
+	// eg. myproj_app
+	ServiceName string
+	// the service in the config, eg. app
+	ServiceType string
+	// short for ServiceType
+	Service     string
+	ProjectName string
+	// from 1 up to the service's scale
+	InstanceNumber int
+	// short for InstanceNumber
+	Instance int
+	// blue or green
+	Color string
+}
+
+func (set *Container) TemplateData() TemplateData {
+	data := TemplateData{
+		Name:           set.Name,
+		ServiceName:    set.ServiceName,
+		ServiceType:    set.ServiceType,
+		Service:        set.ServiceType,
+		ProjectName:    set.ProjectName,
+		InstanceNumber: set.InstanceNumber,
+		Instance:       set.InstanceNumber,
+	}
+	if set.State != nil {
+		data.Color = set.State.Color
+	}
+	return data
+}
+
+// Functions text/template has without any being added, see templateOwner
+var builtinTemplateFuncs = map[string]bool{
+	"and": true, "call": true, "html": true, "index": true, "slice": true, "js": true,
+	"len": true, "not": true, "or": true, "print": true, "printf": true, "println": true,
+	"urlquery": true, "eq": true, "ge": true, "gt": true, "le": true, "lt": true, "ne": true,
+}
+
+// Whether the template's expressions are capitan's or someone else's
+type templateOwner struct {
+	// uses fields of TemplateData
+	capitan bool
+	// uses other fields, `.` itself or functions we don't have, eg. docker's {{json .}}
+	foreign bool
+}
+
+func (o *templateOwner) walk(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ActionNode:
+		o.walk(n.Pipe)
+	case *parse.IfNode:
+		o.walkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		o.walkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		o.walkBranch(&n.BranchNode)
+	case *parse.ListNode:
+		for _, child := range n.Nodes {
+			o.walk(child)
+		}
+	case *parse.PipeNode:
+		for _, cmd := range n.Cmds {
+			o.walk(cmd)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			o.walk(arg)
+		}
+	case *parse.IdentifierNode:
+		if !builtinTemplateFuncs[n.Ident] {
+			o.foreign = true
+		}
+	case *parse.FieldNode:
+		o.walkField(n.Ident[0])
+	case *parse.ChainNode:
+		o.walk(n.Node)
+	case *parse.VariableNode:
+		// $.Name, other variables are declared in the template
+		if n.Ident[0] == "$" {
+			if len(n.Ident) > 1 {
+				o.walkField(n.Ident[1])
+			} else {
+				o.foreign = true
+			}
+		}
+	case *parse.DotNode, *parse.TemplateNode:
+		o.foreign = true
+	}
+}
+
+func (o *templateOwner) walkBranch(n *parse.BranchNode) {
+	o.walk(n.Pipe)
+	o.walk(n.List)
+	if n.ElseList != nil {
+		o.walk(n.ElseList)
+	}
+}
+
+func (o *templateOwner) walkField(name string) {
+	if _, found := reflect.TypeOf(TemplateData{}).FieldByName(name); found {
+		o.capitan = true
+	} else {
+		o.foreign = true
+	}
+}
+
+// Expand the template expressions in a config value.
+// Only expressions using capitan's fields, or none like {{"{{"}}, are expanded.
+// The rest are someone else's, eg. docker's `log-opt tag={{.ImageName}}`, and are left as they are.
+func ExpandTemplate(text string, data TemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tree := parse.New("arg")
+	tree.Mode = parse.SkipFuncCheck
+	if _, err := tree.Parse(text, "", "", map[string]*parse.Tree{}); err != nil {
+		return "", err
+	}
+	owners := make([]*templateOwner, len(tree.Root.Nodes))
+	foreign := false
+	for i, node := range tree.Root.Nodes {
+		owners[i] = new(templateOwner)
+		owners[i].walk(node)
+		if owners[i].capitan && owners[i].foreign {
+			return "", errors.New("`" + node.String() + "` mixes capitan's fields with others")
+		}
+		foreign = foreign || owners[i].foreign
+	}
+	if !foreign {
+		return executeTemplate(text, data)
+	}
+
+	// expand capitan's expressions one by one, passing the others on
+	var out bytes.Buffer
+	for i, node := range tree.Root.Nodes {
+		if textNode, ok := node.(*parse.TextNode); ok {
+			out.Write(textNode.Text)
+			continue
+		}
+		if owners[i].foreign {
+			out.WriteString(node.String())
+			continue
+		}
+		expanded, err := executeTemplate(node.String(), data)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(expanded)
+	}
+	return out.String(), nil
+}
+
+func executeTemplate(text string, data TemplateData) (string, error) {
+	tmpl, err := template.New("arg").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Check a config value's template expressions parse
+func CheckTemplate(text string) error {
+	_, err := ExpandTemplate(text, TemplateData{})
+	return err
+}
+
+// Expand every value
+func (set *Container) expandAll(values []string) ([]interface{}, error) {
+	data := set.TemplateData()
+	expanded := make([]interface{}, len(values))
+	for i, val := range values {
+		out, err := ExpandTemplate(val, data)
+		if err != nil {
+			return nil, errors.New("Failed to expand `" + val + "` for " + set.Name + ": " + err.Error())
+		}
+		expanded[i] = out
+	}
+	return expanded, nil
+}
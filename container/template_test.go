@@ -0,0 +1,47 @@
+package container
+
+import "testing"
+
+func TestExpandTemplate(t *testing.T) {
+	data := TemplateData{
+		Name:           "proj_app_blue_2",
+		ServiceName:    "proj_app",
+		ServiceType:    "app",
+		Service:        "app",
+		ProjectName:    "proj",
+		InstanceNumber: 2,
+		Instance:       2,
+		Color:          "blue",
+	}
+	tests := []struct {
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{text: "plain", want: "plain"},
+		{text: "808{{.Instance}}:80", want: "8082:80"},
+		{text: "{{.Service}}-{{.InstanceNumber}}", want: "app-2"},
+		{text: "{{$.ProjectName}}", want: "proj"},
+		{text: "{{if eq .Color \"blue\"}}b{{else}}g{{end}}", want: "b"},
+		{text: "{{$n := .Name}}{{$n}}", want: "proj_app_blue_2"},
+		{text: "{{printf \"%s-%d\" .Service .Instance}}", want: "app-2"},
+		// docker's own are left alone
+		{text: "tag={{.ImageName}}", want: "tag={{.ImageName}}"},
+		{text: "{{json .}}", want: "{{json .}}"},
+		{text: "{{.ImageName}}/{{.Instance}}", want: "{{.ImageName}}/2"},
+		// escaped
+		{text: `{{"{{.Name}}"}}`, want: "{{.Name}}"},
+		{text: "{{.Name .ImageName}}", wantErr: true},
+		{text: "{{.Service", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ExpandTemplate(test.text, data)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ExpandTemplate(%q) error = %v, want error %v", test.text, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("ExpandTemplate(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
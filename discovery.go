@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"strconv"
+)
+
+// Files listing the project's running containers for other tools,
+// set with `global discovery_file` and `global discovery_hosts`
+type DiscoveryConfig struct {
+	// JSON file
+	File string
+	// /etc/hosts format file
+	Hosts string
+}
+
+// The contents of the JSON discovery file
+type Discovery struct {
+	Project string `json:"project"`
+	// the `global network`, if there is one
+	Network  string                  `json:"network,omitempty"`
+	Services map[string]*LiveService `json:"services"`
+}
+
+// Rewrite the discovery files from the running containers, leaving out those in exclude
+func (settings *ProjectConfig) updateDiscovery(exclude SettingsList, dryRun bool) error {
+	disc := settings.Discovery
+	if disc == nil || dryRun {
+		return nil
+	}
+	services, err := settings.liveServices(exclude)
+	if err != nil {
+		return err
+	}
+
+	if disc.File != "" {
+		data := Discovery{
+			Project:  settings.ProjectName,
+			Network:  settings.Network,
+			Services: make(map[string]*LiveService, len(services)),
+		}
+		for _, svc := range services {
+			data.Services[svc.Name] = svc
+		}
+		out, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = helpers.WriteFileAtomic(disc.File, append(out, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	if disc.Hosts != "" {
+		var out bytes.Buffer
+		fmt.Fprintf(&out, "# Generated by capitan for %s, changes will be overwritten\n", settings.ProjectName)
+		for _, svc := range services {
+			for _, instance := range svc.Instances {
+				if instance.IP == "" {
+					continue
+				}
+				fmt.Fprintf(&out, "%s\t%s %s %s\n", instance.IP, instance.Name, svc.Name+"-"+strconv.Itoa(instance.Instance), svc.Name)
+			}
+		}
+		if err = helpers.WriteFileAtomic(disc.Hosts, out.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update the discovery files after the running containers changed,
+// failing to is only warned about as the containers themselves are fine
+func (settings *ProjectConfig) refreshDiscovery(exclude SettingsList, dryRun bool) {
+	if err := settings.updateDiscovery(exclude, dryRun); err != nil {
+		Warning.Println("Failed to update discovery files:", err)
+	}
+}
@@ -28,7 +28,7 @@ redis scale 1
 mongo image mongo:latest
 mongo command mongod --smallfiles
 mongo hostname ${PREFIX}_mongo
-mongo env test=\$CAPITAN_INSTANCE_NUMBER
+mongo env test={{.InstanceNumber}}
 
 # --------------------------------------------------
 # General nats container
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+type composeFile struct {
+	Version  string                     `yaml:"version"`
+	Services yaml.MapSlice              `yaml:"services"`
+	Networks map[string]*composeNetwork `yaml:"networks,omitempty"`
+}
+
+type composeNetwork struct {
+	External bool `yaml:"external,omitempty"`
+}
+
+type composeBuild struct {
+	Context    string   `yaml:"context"`
+	Dockerfile string   `yaml:"dockerfile,omitempty"`
+	Args       []string `yaml:"args,omitempty"`
+}
+
+type composeLogging struct {
+	Driver  string            `yaml:"driver,omitempty"`
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+type composeDeploy struct {
+	Replicas int `yaml:"replicas,omitempty"`
+}
+
+type composeService struct {
+	Image         string          `yaml:"image,omitempty"`
+	Build         *composeBuild   `yaml:"build,omitempty"`
+	Command       []string        `yaml:"command,omitempty"`
+	Entrypoint    string          `yaml:"entrypoint,omitempty"`
+	Hostname      string          `yaml:"hostname,omitempty"`
+	User          string          `yaml:"user,omitempty"`
+	WorkingDir    string          `yaml:"working_dir,omitempty"`
+	Restart       string          `yaml:"restart,omitempty"`
+	Environment   []string        `yaml:"environment,omitempty"`
+	EnvFile       []string        `yaml:"env_file,omitempty"`
+	Ports         []string        `yaml:"ports,omitempty"`
+	Expose        []string        `yaml:"expose,omitempty"`
+	Volumes       []string        `yaml:"volumes,omitempty"`
+	VolumesFrom   []string        `yaml:"volumes_from,omitempty"`
+	Links         []string        `yaml:"links,omitempty"`
+	ExternalLinks []string        `yaml:"external_links,omitempty"`
+	DependsOn     []string        `yaml:"depends_on,omitempty"`
+	Profiles      []string        `yaml:"profiles,omitempty"`
+	Labels        []string        `yaml:"labels,omitempty"`
+	Networks      []string        `yaml:"networks,omitempty"`
+	NetworkMode   string          `yaml:"network_mode,omitempty"`
+	DNS           []string        `yaml:"dns,omitempty"`
+	CapAdd        []string        `yaml:"cap_add,omitempty"`
+	CapDrop       []string        `yaml:"cap_drop,omitempty"`
+	Privileged    bool            `yaml:"privileged,omitempty"`
+	Logging       *composeLogging `yaml:"logging,omitempty"`
+	Scale         int             `yaml:"scale,omitempty"`
+	Deploy        *composeDeploy  `yaml:"deploy,omitempty"`
+}
+
+// network modes which aren't user defined networks
+var builtinNetworkModes = []string{"bridge", "host", "none", "default"}
+
+// A passthrough docker run argument, eg `--env FOO=bar`
+type runArg struct {
+	Name  string
+	Value string
+}
+
+// Split the passthrough container args back into name/value pairs.
+// Flags without a value (eg --privileged) get an empty value.
+func splitContainerArgs(args []string) []runArg {
+	pairs := make([]runArg, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			continue
+		}
+		pair := runArg{Name: strings.TrimPrefix(args[i], "--")}
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			pair.Value = args[i+1]
+			i++
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+type composeExporter struct {
+	version  string
+	networks map[string]*composeNetwork
+	warnings int
+}
+
+func (e *composeExporter) warn(service string, format string, args ...interface{}) {
+	e.warnings++
+	Warning.Printf(service+": "+format+"\n", args...)
+}
+
+func (e *composeExporter) isV3() bool {
+	return strings.HasPrefix(e.version, "3")
+}
+
+// compose only has `scale` from 2.2
+func (e *composeExporter) supportsScale() bool {
+	return e.version != "2" && e.version != "2.0" && e.version != "2.1"
+}
+
+func (e *composeExporter) exportBuild(set *container.Container) *composeBuild {
+	build := &composeBuild{Context: set.Build}
+	buildArgs := set.BuildArgs
+	for i := 0; i < len(buildArgs); i++ {
+		arg := buildArgs[i]
+		var value string
+		if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
+			arg, value = parts[0], parts[1]
+		} else if i+1 < len(buildArgs) && (arg == "--build-arg" || arg == "--file" || arg == "-f") {
+			value = buildArgs[i+1]
+			i++
+		}
+		switch arg {
+		case "--build-arg":
+			build.Args = append(build.Args, value)
+		case "--file", "-f":
+			build.Dockerfile = value
+		default:
+			e.warn(set.ServiceType, "build argument %s has no compose equivalent", arg)
+		}
+	}
+	return build
+}
+
+func (e *composeExporter) exportService(set *container.Container) *composeService {
+	svc := &composeService{
+		Image:   set.Image,
+		Command: set.Command,
+	}
+	if set.Build != "" {
+		svc.Build = e.exportBuild(set)
+	}
+
+	for _, dep := range set.Dependencies {
+		target := dep.Service
+		if dep.Alias != "" {
+			target += ":" + dep.Alias
+		}
+		switch {
+		case dep.Kind == container.LinkDependency && dep.External:
+			svc.ExternalLinks = append(svc.ExternalLinks, target)
+		case dep.Kind == container.LinkDependency:
+			svc.Links = append(svc.Links, target)
+		case dep.Kind == container.VolumesFromDependency && e.isV3():
+			e.warn(set.ServiceType, "volumes-from %s is not supported in compose v3", dep.Service)
+		case dep.Kind == container.VolumesFromDependency && dep.External:
+			svc.VolumesFrom = append(svc.VolumesFrom, "container:"+dep.Service)
+		case dep.Kind == container.VolumesFromDependency:
+			svc.VolumesFrom = append(svc.VolumesFrom, dep.Service)
+		case dep.Kind == container.DependsOnDependency, dep.Kind == container.ServiceEnvDependency:
+			if !helpers.StringInSlice(dep.Service, svc.DependsOn) {
+				svc.DependsOn = append(svc.DependsOn, dep.Service)
+			}
+		}
+	}
+	// compose services reach each other by name
+	for _, env := range set.ServiceEnvs {
+		svc.Environment = append(svc.Environment, env.Var+"="+env.NamedAddress())
+	}
+
+	svc.Profiles = set.Profiles
+
+	if set.Scale > 1 {
+		if e.isV3() {
+			svc.Deploy = &composeDeploy{Replicas: set.Scale}
+		} else if e.supportsScale() {
+			svc.Scale = set.Scale
+		} else {
+			e.warn(set.ServiceType, "scale needs compose version 2.2 or later")
+		}
+	}
+
+	if set.BlueGreenMode == container.BGModeOn {
+		e.warn(set.ServiceType, "blue-green has no compose equivalent")
+	}
+	if set.Remove {
+		e.warn(set.ServiceType, "rm has no compose equivalent")
+	}
+	hookNames := make([]string, 0, len(set.Hooks))
+	for name := range set.Hooks {
+		hookNames = append(hookNames, name)
+	}
+	sort.Strings(hookNames)
+	for _, name := range hookNames {
+		e.warn(set.ServiceType, "hook %s has no compose equivalent", name)
+	}
+
+	for _, arg := range splitContainerArgs(set.ContainerArgs) {
+		switch arg.Name {
+		case "env", "e":
+			svc.Environment = append(svc.Environment, arg.Value)
+		case "env-file":
+			svc.EnvFile = append(svc.EnvFile, arg.Value)
+		case "publish", "p":
+			svc.Ports = append(svc.Ports, arg.Value)
+		case "expose":
+			svc.Expose = append(svc.Expose, arg.Value)
+		case "volume", "v":
+			svc.Volumes = append(svc.Volumes, arg.Value)
+		case "hostname", "h":
+			svc.Hostname = arg.Value
+		case "restart":
+			svc.Restart = arg.Value
+		case "label", "l":
+			svc.Labels = append(svc.Labels, arg.Value)
+		case "entrypoint":
+			svc.Entrypoint = arg.Value
+		case "user", "u":
+			svc.User = arg.Value
+		case "workdir", "w":
+			svc.WorkingDir = arg.Value
+		case "dns":
+			svc.DNS = append(svc.DNS, arg.Value)
+		case "cap-add":
+			svc.CapAdd = append(svc.CapAdd, arg.Value)
+		case "cap-drop":
+			svc.CapDrop = append(svc.CapDrop, arg.Value)
+		case "privileged":
+			svc.Privileged = arg.Value == "" || arg.Value == "true"
+		case "log-driver":
+			if svc.Logging == nil {
+				svc.Logging = &composeLogging{}
+			}
+			svc.Logging.Driver = arg.Value
+		case "log-opt":
+			if svc.Logging == nil {
+				svc.Logging = &composeLogging{}
+			}
+			if svc.Logging.Options == nil {
+				svc.Logging.Options = make(map[string]string)
+			}
+			optParts := strings.SplitN(arg.Value, "=", 2)
+			if len(optParts) == 2 {
+				svc.Logging.Options[optParts[0]] = optParts[1]
+			}
+		case "net", "network":
+			if helpers.StringInSlice(arg.Value, builtinNetworkModes) || strings.Contains(arg.Value, ":") {
+				svc.NetworkMode = arg.Value
+			} else {
+				svc.Networks = append(svc.Networks, arg.Value)
+				e.networks[arg.Value] = &composeNetwork{External: true}
+			}
+		default:
+			e.warn(set.ServiceType, "%s has no compose equivalent", arg.Name)
+		}
+	}
+	return svc
+}
+
+// Convert the parsed config into a compose file of the given version
+func (e *composeExporter) Export(settings *ProjectConfig) *composeFile {
+	e.networks = make(map[string]*composeNetwork)
+	file := &composeFile{
+		Version: e.version,
+	}
+
+	// the whole config, profiles are exported as they are
+	list := settings.ServiceList
+	sort.Sort(list)
+	for _, set := range list {
+		file.Services = append(file.Services, yaml.MapItem{
+			Key:   set.ServiceType,
+			Value: e.exportService(set),
+		})
+	}
+	if len(e.networks) > 0 {
+		file.Networks = e.networks
+	}
+	return file
+}
+
+// Write the config out in another tool's format
+func (settings *ProjectConfig) CapitanExport(format string, version string, out string) error {
+	if format != "compose" {
+		return errors.New("Unsupported export format: " + format)
+	}
+	exporter := &composeExporter{version: version}
+	data, err := yaml.Marshal(exporter.Export(settings))
+	if err != nil {
+		return err
+	}
+	if exporter.warnings > 0 {
+		Warning.Printf("%d directives could not be exported\n", exporter.warnings)
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(out, data, 0644)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"reflect"
+	"testing"
+)
+
+func TestSplitContainerArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []runArg
+	}{
+		{nil, []runArg{}},
+		{[]string{"--env", "A=1"}, []runArg{{"env", "A=1"}}},
+		{[]string{"--privileged", "--env", "A=1"}, []runArg{{"privileged", ""}, {"env", "A=1"}}},
+		{[]string{"--env", "A=1", "--rm"}, []runArg{{"env", "A=1"}, {"rm", ""}}},
+		{[]string{"stray", "--net", "back"}, []runArg{{"net", "back"}}},
+	}
+	for _, test := range tests {
+		got := splitContainerArgs(test.args)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitContainerArgs(%v) = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestExportServiceArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		want     *composeService
+		networks []string
+		warnings int
+	}{
+		{[]string{"--env", "A=1", "--e", "B=2"}, &composeService{Environment: []string{"A=1", "B=2"}}, nil, 0},
+		{[]string{"--env-file", ".env"}, &composeService{EnvFile: []string{".env"}}, nil, 0},
+		{[]string{"--p", "80:80", "--publish", "443:443"}, &composeService{Ports: []string{"80:80", "443:443"}}, nil, 0},
+		{[]string{"--expose", "8080"}, &composeService{Expose: []string{"8080"}}, nil, 0},
+		{[]string{"--v", "/data:/data"}, &composeService{Volumes: []string{"/data:/data"}}, nil, 0},
+		{[]string{"--hostname", "web", "--user", "app", "--workdir", "/app"}, &composeService{Hostname: "web", User: "app", WorkingDir: "/app"}, nil, 0},
+		{[]string{"--restart", "always", "--entrypoint", "/init"}, &composeService{Restart: "always", Entrypoint: "/init"}, nil, 0},
+		{[]string{"--label", "tier=front"}, &composeService{Labels: []string{"tier=front"}}, nil, 0},
+		{[]string{"--dns", "8.8.8.8", "--cap-add", "NET_ADMIN", "--cap-drop", "MKNOD"}, &composeService{DNS: []string{"8.8.8.8"}, CapAdd: []string{"NET_ADMIN"}, CapDrop: []string{"MKNOD"}}, nil, 0},
+		{[]string{"--privileged"}, &composeService{Privileged: true}, nil, 0},
+		{[]string{"--privileged", "false"}, &composeService{}, nil, 0},
+		{
+			[]string{"--log-driver", "syslog", "--log-opt", "tag=web"},
+			&composeService{Logging: &composeLogging{Driver: "syslog", Options: map[string]string{"tag": "web"}}},
+			nil, 0,
+		},
+		{[]string{"--net", "host"}, &composeService{NetworkMode: "host"}, nil, 0},
+		{[]string{"--net", "container:db"}, &composeService{NetworkMode: "container:db"}, nil, 0},
+		{[]string{"--network", "back"}, &composeService{Networks: []string{"back"}}, []string{"back"}, 0},
+		{[]string{"--memory", "1g"}, &composeService{}, nil, 1},
+	}
+	for _, test := range tests {
+		e := &composeExporter{version: "3", networks: make(map[string]*composeNetwork)}
+		got := e.exportService(&container.Container{ServiceType: "web", ContainerArgs: test.args})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.args, got, test.want)
+		}
+		for _, name := range test.networks {
+			if network, found := e.networks[name]; !found || !network.External {
+				t.Errorf("%v: network %s not declared external", test.args, name)
+			}
+		}
+		if e.warnings != test.warnings {
+			t.Errorf("%v: got %d warnings, want %d", test.args, e.warnings, test.warnings)
+		}
+	}
+}
+
+func TestExportServiceScale(t *testing.T) {
+	tests := []struct {
+		version  string
+		scale    int
+		want     int
+		replicas int
+		warnings int
+	}{
+		{"3", 1, 0, 0, 0},
+		{"3", 3, 0, 3, 0},
+		{"3.4", 2, 0, 2, 0},
+		{"2.2", 3, 3, 0, 0},
+		{"2.4", 3, 3, 0, 0},
+		{"2", 3, 0, 0, 1},
+		{"2.1", 3, 0, 0, 1},
+	}
+	for _, test := range tests {
+		e := &composeExporter{version: test.version, networks: make(map[string]*composeNetwork)}
+		got := e.exportService(&container.Container{ServiceType: "web", Scale: test.scale})
+		var replicas int
+		if got.Deploy != nil {
+			replicas = got.Deploy.Replicas
+		}
+		if got.Scale != test.want || replicas != test.replicas || e.warnings != test.warnings {
+			t.Errorf("version %s, scale %d: got scale %d, replicas %d, %d warnings, want %d, %d, %d",
+				test.version, test.scale, got.Scale, replicas, e.warnings, test.want, test.replicas, test.warnings)
+		}
+	}
+}
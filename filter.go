@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"github.com/byrnedo/capitan/container"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Selects the containers commands act on, given with --filter.
+// A comma separated list of selectors, a container is selected if it matches any of them:
+//
+//	app          a service, may be a glob, eg. worker-*
+//	app:2        a single instance of a service
+//	app@green    instances of a service currently on that colour
+//	label=k=v    services with that label in the config, label=k for any value
+//
+// An empty filter selects everything.
+type ContainerFilter []*filterSelector
+
+type filterSelector struct {
+	// glob matched against the service type
+	Service string
+	// instance number, 0 for any
+	Instance int
+	// blue/green colour, empty for any
+	Color string
+	// label selectors match the config's labels instead
+	IsLabel    bool
+	LabelKey   string
+	LabelValue string
+	// label=k was given, any value matches
+	AnyValue bool
+}
+
+func ParseContainerFilter(expr string) (ContainerFilter, error) {
+	var filter ContainerFilter
+	for _, part := range strings.Split(expr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		sel, err := parseFilterSelector(part)
+		if err != nil {
+			return nil, errors.New("Invalid filter `" + part + "`: " + err.Error())
+		}
+		filter = append(filter, sel)
+	}
+	return filter, nil
+}
+
+func parseFilterSelector(part string) (*filterSelector, error) {
+	sel := new(filterSelector)
+
+	if strings.HasPrefix(part, "label=") {
+		sel.IsLabel = true
+		keyVal := strings.SplitN(strings.TrimPrefix(part, "label="), "=", 2)
+		sel.LabelKey = keyVal[0]
+		if sel.LabelKey == "" {
+			return nil, errors.New("label key is empty")
+		}
+		if len(keyVal) > 1 {
+			sel.LabelValue = keyVal[1]
+		} else {
+			sel.AnyValue = true
+		}
+		return sel, nil
+	}
+
+	if i := strings.LastIndex(part, "@"); i >= 0 {
+		sel.Color = part[i+1:]
+		if sel.Color != "blue" && sel.Color != "green" {
+			return nil, errors.New("colour must be blue or green")
+		}
+		part = part[:i]
+	}
+	if i := strings.LastIndex(part, ":"); i >= 0 {
+		instance, err := strconv.Atoi(part[i+1:])
+		if err != nil || instance < 1 {
+			return nil, errors.New("instance must be a number from 1")
+		}
+		sel.Instance = instance
+		part = part[:i]
+	}
+	if part == "" {
+		return nil, errors.New("service is empty")
+	}
+	if _, err := path.Match(part, ""); err != nil {
+		return nil, err
+	}
+	sel.Service = part
+	return sel, nil
+}
+
+// Whether any of the service's containers could be selected
+func (f ContainerFilter) MatchService(ctr *container.Container) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, sel := range f {
+		if sel.matchService(ctr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether this container, an instance of a service, is selected
+func (f ContainerFilter) Match(ctr *container.Container) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, sel := range f {
+		if !sel.matchService(ctr) {
+			continue
+		}
+		if sel.Instance != 0 && sel.Instance != ctr.InstanceNumber {
+			continue
+		}
+		if sel.Color != "" && (ctr.State == nil || ctr.State.Color != sel.Color) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func (sel *filterSelector) matchService(ctr *container.Container) bool {
+	if sel.IsLabel {
+		val, found := containerLabels(ctr)[sel.LabelKey]
+		return found && (sel.AnyValue || val == sel.LabelValue)
+	}
+	matched, _ := path.Match(sel.Service, ctr.ServiceType)
+	return matched
+}
+
+// Whether any selector needs labels, see containerLabels
+func (f ContainerFilter) usesLabels() bool {
+	for _, sel := range f {
+		if sel.IsLabel {
+			return true
+		}
+	}
+	return false
+}
+
+// The labels label selectors are matched against. Orphans have no config
+// so it's the labels docker has for them, otherwise it's the config's.
+func containerLabels(ctr *container.Container) map[string]string {
+	if ctr.State != nil && ctr.State.Labels != nil {
+		return ctr.State.Labels
+	}
+	return configLabels(ctr)
+}
+
+// The labels set with `label` in the container's config, with their templates expanded
+func configLabels(ctr *container.Container) map[string]string {
+	labels := make(map[string]string)
+	data := ctr.TemplateData()
+	for i := 0; i < len(ctr.ContainerArgs)-1; i++ {
+		if ctr.ContainerArgs[i] != "--label" {
+			continue
+		}
+		i++
+		label, err := container.ExpandTemplate(ctr.ContainerArgs[i], data)
+		if err != nil {
+			continue
+		}
+		keyVal := strings.SplitN(label, "=", 2)
+		if len(keyVal) > 1 {
+			labels[keyVal[0]] = keyVal[1]
+		} else {
+			labels[keyVal[0]] = ""
+		}
+	}
+	return labels
+}
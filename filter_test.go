@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	"reflect"
+	"testing"
+)
+
+func TestParseContainerFilter(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    ContainerFilter
+		wantErr bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"web", ContainerFilter{{Service: "web"}}, false},
+		{"worker-*", ContainerFilter{{Service: "worker-*"}}, false},
+		{"web:2", ContainerFilter{{Service: "web", Instance: 2}}, false},
+		{"web@green", ContainerFilter{{Service: "web", Color: "green"}}, false},
+		{"web:1@blue", ContainerFilter{{Service: "web", Instance: 1, Color: "blue"}}, false},
+		{"label=tier=front", ContainerFilter{{IsLabel: true, LabelKey: "tier", LabelValue: "front"}}, false},
+		{"label=tier", ContainerFilter{{IsLabel: true, LabelKey: "tier", AnyValue: true}}, false},
+		{"label=tier=", ContainerFilter{{IsLabel: true, LabelKey: "tier"}}, false},
+		{"web, db", ContainerFilter{{Service: "web"}, {Service: "db"}}, false},
+		{"label=", nil, true},
+		{"web:0", nil, true},
+		{"web:x", nil, true},
+		{"web@red", nil, true},
+		{":1", nil, true},
+		{"@blue", nil, true},
+		{"web[", nil, true},
+		{"web,db:x", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseContainerFilter(test.expr)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseContainerFilter(%q) error = %v, want error %v", test.expr, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseContainerFilter(%q) = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestContainerFilterMatch(t *testing.T) {
+	web := &container.Container{
+		ServiceType:    "web",
+		InstanceNumber: 2,
+		ContainerArgs:  []string{"--label", "tier=front", "--label", "slot={{.Instance}}", "--label", "canary"},
+		State:          &helpers.ServiceState{Color: "green"},
+	}
+	orphan := &container.Container{
+		ServiceType:    "old",
+		InstanceNumber: 1,
+		State:          &helpers.ServiceState{Labels: map[string]string{"tier": "back"}},
+	}
+	tests := []struct {
+		expr string
+		ctr  *container.Container
+		want bool
+	}{
+		{"", web, true},
+		{"web", web, true},
+		{"we*", web, true},
+		{"db", web, false},
+		{"web:2", web, true},
+		{"web:1", web, false},
+		{"web@green", web, true},
+		{"web@blue", web, false},
+		{"db,web:2", web, true},
+		{"label=tier=front", web, true},
+		{"label=tier=back", web, false},
+		{"label=tier", web, true},
+		{"label=slot=2", web, true},
+		{"label=slot={{.Instance}}", web, false},
+		{"label=canary", web, true},
+		{"label=missing", web, false},
+		{"label=tier=back", orphan, true},
+		{"label=tier=front", orphan, false},
+		{"old:1", orphan, true},
+	}
+	for _, test := range tests {
+		filter, err := ParseContainerFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseContainerFilter(%q) error = %v", test.expr, err)
+			continue
+		}
+		if got := filter.Match(test.ctr); got != test.want {
+			t.Errorf("Match(%q) on %s = %v, want %v", test.expr, test.ctr.ServiceType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"github.com/byrnedo/capitan/container"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A service in the dependency graph
+type GraphNode struct {
+	Service   string `json:"service" yaml:"service"`
+	Order     int    `json:"order" yaml:"order"`
+	Scale     int    `json:"scale" yaml:"scale"`
+	BlueGreen bool   `json:"blueGreen" yaml:"blueGreen"`
+	Image     string `json:"image,omitempty" yaml:"image,omitempty"`
+	Build     string `json:"build,omitempty" yaml:"build,omitempty"`
+	// referred to but not defined in the config
+	External bool `json:"external" yaml:"external"`
+}
+
+// A dependency between two services
+type GraphEdge struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+	// one of link, volumes-from or depends-on
+	Kind  string `json:"kind" yaml:"kind"`
+	Alias string `json:"alias,omitempty" yaml:"alias,omitempty"`
+	// the dependency is started after the service which needs it
+	OutOfOrder bool `json:"outOfOrder" yaml:"outOfOrder"`
+}
+
+type Graph struct {
+	Project string       `json:"project" yaml:"project"`
+	Nodes   []*GraphNode `json:"nodes" yaml:"nodes"`
+	Edges   []*GraphEdge `json:"edges" yaml:"edges"`
+}
+
+// Build the service graph from the parsed config
+func newGraph(settings *ProjectConfig) *Graph {
+	graph := &Graph{
+		Project: settings.ProjectName,
+		Nodes:   make([]*GraphNode, 0),
+		Edges:   make([]*GraphEdge, 0),
+	}
+
+	// every service, whatever profiles are active
+	services := make(map[string]*container.Container)
+	list := settings.ServiceList
+	sort.Sort(list)
+	for _, set := range list {
+		services[set.ServiceType] = set
+		node := &GraphNode{
+			Service:   set.ServiceType,
+			Order:     set.Placement,
+			Scale:     set.Scale,
+			BlueGreen: set.BlueGreenMode == container.BGModeOn,
+			Build:     set.Build,
+		}
+		if set.Build == "" {
+			node.Image = set.Image
+		}
+		graph.Nodes = append(graph.Nodes, node)
+	}
+
+	external := make(map[string]bool)
+	for _, node := range graph.Nodes {
+		set := services[node.Service]
+		for _, dep := range set.Dependencies {
+			edge := &GraphEdge{
+				From:  set.ServiceType,
+				To:    dep.Service,
+				Kind:  string(dep.Kind),
+				Alias: dep.Alias,
+			}
+			if target, found := services[dep.Service]; found {
+				edge.OutOfOrder = target.Placement > set.Placement
+			} else if !external[dep.Service] {
+				// external, or disabled
+				external[dep.Service] = true
+				graph.Nodes = append(graph.Nodes, &GraphNode{
+					Service:  dep.Service,
+					Order:    -1,
+					External: dep.External,
+				})
+			}
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+	return graph
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// Write the graph in graphviz DOT format.
+// Edges point from a service to what it depends on, out of order edges are red.
+func (graph *Graph) WriteDot(w io.Writer) error {
+	lines := []string{"digraph " + dotQuote(graph.Project) + " {"}
+	for _, node := range graph.Nodes {
+		var attrs []string
+		if node.External {
+			attrs = append(attrs, `label=`+dotQuote(node.Service+"\n(external)"), "style=dashed")
+		} else {
+			label := fmt.Sprintf("%s\nscale: %d", node.Service, node.Scale)
+			if node.Build != "" {
+				label += "\nbuild: " + node.Build
+			} else if node.Image != "" {
+				label += "\nimage: " + node.Image
+			}
+			if node.BlueGreen {
+				label += "\nblue/green"
+				attrs = append(attrs, "peripheries=2")
+			}
+			attrs = append(attrs, "label="+dotQuote(label), "shape=box")
+		}
+		lines = append(lines, fmt.Sprintf("  %s [%s];", dotQuote(node.Service), strings.Join(attrs, ", ")))
+	}
+	for _, edge := range graph.Edges {
+		label := edge.Kind
+		if edge.Alias != "" {
+			label += ": " + edge.Alias
+		}
+		attrs := []string{"label=" + dotQuote(label)}
+		switch edge.Kind {
+		case string(container.VolumesFromDependency):
+			attrs = append(attrs, "style=dashed")
+		case string(container.DependsOnDependency):
+			attrs = append(attrs, "style=dotted")
+		}
+		if edge.OutOfOrder {
+			attrs = append(attrs, "color=red", "fontcolor=red")
+		}
+		lines = append(lines, fmt.Sprintf("  %s -> %s [%s];", dotQuote(edge.From), dotQuote(edge.To), strings.Join(attrs, ", ")))
+	}
+	lines = append(lines, "}")
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
@@ -1,22 +1,26 @@
 package helpers
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	. "github.com/byrnedo/capitan/consts"
 	"github.com/byrnedo/capitan/logger"
 	. "github.com/byrnedo/capitan/logger"
-	"github.com/codeskyblue/go-sh"
+	"github.com/byrnedo/capitan/shellsession"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 "strconv"
 )
 
 func ContainerExitCode(containerName string) string {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{.State.ExitCode}}", containerName).Output()
 	if err != nil {
@@ -27,7 +31,7 @@ func ContainerExitCode(containerName string) string {
 }
 
 func WasContainerStartedAfter(name string, afterTime time.Time) (bool, error) {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{.State.StartedAt}}", name).Output()
 	if err != nil {
@@ -65,9 +69,41 @@ func WasContainerStartedAfterOrRetry(name string, afterTime time.Time, maxAttemp
 	return false
 }
 
+// Wait for a container to be ready, healthy if it has a healthcheck, otherwise running.
+// Fails if it stops, becomes unhealthy or isn't ready within the timeout.
+func WaitUntilReady(name string, timeout time.Duration, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ses := shellsession.NewSession()
+		ses.Stderr = ioutil.Discard
+		out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{.State.Status}} {{if .State.Health}}{{.State.Health.Status}}{{end}}", name).Output()
+		if err != nil {
+			return err
+		}
+		state := strings.Fields(string(out))
+		switch {
+		case len(state) == 0:
+			return errors.New("no state for " + name)
+		case state[0] == "exited" || state[0] == "dead":
+			return errors.New(name + " stopped before it was ready")
+		case len(state) > 1 && state[1] == "unhealthy":
+			return errors.New(name + " is unhealthy")
+		case len(state) > 1 && state[1] == "healthy":
+			return nil
+		case len(state) == 1 && state[0] == "running":
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("%s wasn't ready after %s", name, timeout))
+		}
+		time.Sleep(interval)
+	}
+}
+
 //Get the id for a given image name
 func GetImageId(imageName string) string {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--type", "image", "--format", "{{.Id}}", imageName).Output()
 	if err != nil {
@@ -79,13 +115,13 @@ func GetImageId(imageName string) string {
 
 //pull the image for a given image name
 func PullImage(imageName string) error {
-	err := sh.Command("docker", "pull", imageName).Run()
+	err := shellsession.NewSession().Command("docker", "pull", imageName).Run()
 	return err
 }
 
 // Get the image id for a given container
 func GetContainerImageId(name string) string {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{.Image}}", name).Output()
 	if err != nil {
@@ -98,7 +134,7 @@ func GetContainerImageId(name string) string {
 
 // Checks if a container exists
 func ContainerExists(name string) bool {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--format", "{{.State.Running}}", name).Output()
 	if err != nil {
@@ -113,7 +149,7 @@ func ContainerExists(name string) bool {
 
 // Check if a container is running
 func ContainerIsRunning(name string) bool {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--format", "{{.State.Running}}", name).Output()
 	if err != nil {
@@ -127,7 +163,7 @@ func ContainerIsRunning(name string) bool {
 
 // Helper to run a docker command
 func RunCmd(args ...interface{}) (out []byte, err error) {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 
 	if logger.GetLevel() == DebugLevel {
 		ses.ShowCMD = true
@@ -154,14 +190,14 @@ func GetContainerServiceNameLabel(containerName string) string {
 }
 
 func RenameContainer(currentName string, newName string) error {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	_, err := ses.Command("docker", "rename", currentName, newName).Output()
 	return err
 }
 
 func getLabel(label string, container string) string {
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Stderr = ioutil.Discard
 	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{.Config.Labels."+label+"}}", container).Output()
 	if err != nil {
@@ -171,6 +207,21 @@ func getLabel(label string, container string) string {
 	return value
 }
 
+// Get the ids of the project's running containers
+func RunningProjectContainers(projName string) ([]string, error) {
+	ses := shellsession.NewSession()
+	ses.Stderr = ioutil.Discard
+	out, err := ses.Command("docker",
+		"ps",
+		"-q",
+		"--filter", fmt.Sprintf("label=%s=%s", ProjectLabelName, projName),
+		"--filter", "status=running").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
 type ServiceState struct {
 	ID   string
 	Name string
@@ -179,16 +230,29 @@ type ServiceState struct {
 	Color string
 	Running bool
 	ArgsHash string
+	// docker's status string, eg "Up 2 hours"
+	Status string
+	// published ports, eg "0.0.0.0:80->80/tcp"
+	Ports []string
+	Image string
+	// capitan labels the container was created without
+	MissingLabels []string
+	// not created by capitan, only part of the project by its name, see `init --adopt`
+	Adopted bool
+	// all of the container's labels, only looked up for orphans
+	Labels map[string]string
 }
 
-func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceState, err error) {
-	ses := sh.NewSession()
+// Get the project's containers, keyed by service name and instance number.
+// names is used to work out the instance of containers without capitan's labels.
+// Containers without any capitan labels are included when they're named as the project's, see `init --adopt`.
+func GetProjectState(projName string, projSep string, names *NameTemplate) (svcs map[string]*ServiceState, err error) {
+	ses := shellsession.NewSession()
 	out, err := ses.Command("docker",
 		"ps",
-		"-af",
-		fmt.Sprintf("label=%s=%s", ProjectLabelName, projName),
+		"-a",
 		"--format",
-		fmt.Sprintf(`{{.ID}}\t{{.Names}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Status}}\t{{.Label "%s"}}`, ColorLabelName, ServiceLabelName, ContainerNumberLabelName, UniqueLabelName)).Output()
+		fmt.Sprintf(`{{.ID}}\t{{.Names}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Label "%s"}}\t{{.Status}}\t{{.Label "%s"}}\t{{.Ports}}\t{{.Image}}\t{{.Label "%s"}}`, ColorLabelName, ServiceLabelName, ContainerNumberLabelName, UniqueLabelName, ProjectLabelName)).Output()
 	if err != nil {
 		return
 	}
@@ -209,15 +273,26 @@ func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceS
 		}
 
 		id := string(lineParts[0])
-		names := string(lineParts[1])
+		name := filepath.Base(string(lineParts[1]))
+
+		var project string
+		if len(lineParts) > 9 {
+			project = string(lineParts[9])
+		}
+		adopted := project == ""
+		if adopted {
+			// only the project's if it has one of the project's names, legacy names could be anyone's
+			if _, parseErr := ParseName(name, projName, projSep, names, DefaultNames); parseErr != nil {
+				continue
+			}
+		} else if project != projName {
+			continue
+		}
 
 		var color string
 		if len(lineParts) > 2 {
 			color = string(lineParts[2])
 		}
-		if color == "" {
-			color = "blue"
-		}
 
 		var serviceName string
 		if len(lineParts) > 3 {
@@ -225,18 +300,52 @@ func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceS
 		}
 
 		var instanceNum int
+		var instanceErr error = errors.New("no instance label")
 		if len(lineParts) > 4 {
-			if instanceNum, err = strconv.Atoi(string(lineParts[4])); err != nil {
-				Warning.Println("Instance number label missing, parsing from name")
-				if instanceNum, err = GetNumericSuffix(names, projSep); err != nil {
-					return nil, errors.New("Failed to parse instance number for container: " + names)
+			instanceNum, instanceErr = strconv.Atoi(string(lineParts[4]))
+		}
+
+		var missing []string
+		if adopted {
+			missing = append(missing, ProjectLabelName)
+		}
+		if color == "" {
+			missing = append(missing, ColorLabelName)
+		}
+		if serviceName == "" {
+			missing = append(missing, ServiceLabelName)
+		}
+		if instanceErr != nil {
+			missing = append(missing, ContainerNumberLabelName)
+		}
+		if len(missing) > 0 {
+			// made by an older capitan, work out what we can from the name
+			Debug.Printf("%s is missing labels %s, parsing from name\n", name, strings.Join(missing, ", "))
+			fields, parseErr := ParseName(name, projName, projSep, names, DefaultNames, LegacyNames)
+			if instanceErr != nil {
+				if parseErr != nil {
+					return nil, errors.New("Failed to parse instance number for container: " + name)
 				}
+				instanceNum = fields.Instance
+			}
+			if serviceName == "" && parseErr == nil {
+				serviceName = projName + projSep + fields.Service
+			}
+			if color == "" {
+				color = fields.Color
 			}
 		}
+		if color == "" {
+			color = "blue"
+		}
 
-		var running = false
+		var (
+			running = false
+			status  string
+		)
 		if len(lineParts) > 5 {
-			if bytes.HasPrefix(bytes.TrimSpace(lineParts[5]), []byte("Up")){
+			status = string(bytes.TrimSpace(lineParts[5]))
+			if strings.HasPrefix(status, "Up") {
 				running = true
 			}
 		}
@@ -246,17 +355,199 @@ func GetProjectState(projName string, projSep string) (svcs map[string]*ServiceS
 			argsHash = string(lineParts[6])
 		}
 
-		name := filepath.Base(names)
-		svcs[serviceName + projSep + strconv.Itoa(instanceNum)] = &ServiceState{
-			ID: id,
-			Name: name,
-			ServiceName: serviceName,
-			InstanceNum: instanceNum,
-			Color: color,
-			Running: running,
-			ArgsHash : argsHash,
+		var ports []string
+		if len(lineParts) > 7 {
+			for _, port := range strings.Split(string(lineParts[7]), ",") {
+				if port = strings.TrimSpace(port); port != "" {
+					ports = append(ports, port)
+				}
+			}
+		}
+
+		var image string
+		if len(lineParts) > 8 {
+			image = string(lineParts[8])
+		}
+
+		svcs[serviceName+projSep+strconv.Itoa(instanceNum)] = &ServiceState{
+			ID:            id,
+			Name:          name,
+			ServiceName:   serviceName,
+			InstanceNum:   instanceNum,
+			Color:         color,
+			Running:       running,
+			ArgsHash:      argsHash,
+			Status:        status,
+			Ports:         ports,
+			Image:         image,
+			MissingLabels: missing,
+			Adopted:       adopted,
 		}
 	}
 	return
 }
 
+type ContainerEvent struct {
+	// unix time of the event
+	Time int64
+	// docker's event name, eg "start" or "die"
+	Action      string
+	Name        string
+	ServiceName string
+	ServiceType string
+	InstanceNum int
+	Color       string
+}
+
+// Stream start and die events for a project's containers.
+// The channel is closed when `docker events` exits, which stop makes it do.
+func ProjectContainerEvents(projName string) (events <-chan *ContainerEvent, stop func(), err error) {
+	ses := shellsession.NewSession()
+	ses.Stderr = ioutil.Discard
+	if logger.GetLevel() == DebugLevel {
+		ses.ShowCMD = true
+	}
+
+	pipeOut, pipeIn := io.Pipe()
+	ses.Stdout = pipeIn
+	ses.Command("docker",
+		"events",
+		"--filter", "type=container",
+		"--filter", fmt.Sprintf("label=%s=%s", ProjectLabelName, projName),
+		"--filter", "event=start",
+		"--filter", "event=die",
+		"--format",
+		strings.Join([]string{
+			"{{.Time}}",
+			"{{.Action}}",
+			"{{.Actor.Attributes.name}}",
+			fmt.Sprintf(`{{index .Actor.Attributes "%s"}}`, ServiceLabelName),
+			fmt.Sprintf(`{{index .Actor.Attributes "%s"}}`, ServiceLabelType),
+			fmt.Sprintf(`{{index .Actor.Attributes "%s"}}`, ContainerNumberLabelName),
+			fmt.Sprintf(`{{index .Actor.Attributes "%s"}}`, ColorLabelName),
+		}, "\t"))
+	if err := ses.Start(); err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		ses.Wait()
+		pipeIn.Close()
+	}()
+
+	eventsOut := make(chan *ContainerEvent)
+	go func() {
+		defer close(eventsOut)
+		scanner := bufio.NewScanner(pipeOut)
+		for scanner.Scan() {
+			lineParts := strings.Split(scanner.Text(), "\t")
+			if len(lineParts) < 7 {
+				continue
+			}
+			evTime, _ := strconv.ParseInt(lineParts[0], 10, 64)
+			instanceNum, _ := strconv.Atoi(lineParts[5])
+			color := lineParts[6]
+			if color == "" {
+				color = "blue"
+			}
+			eventsOut <- &ContainerEvent{
+				Time:        evTime,
+				Action:      lineParts[1],
+				Name:        lineParts[2],
+				ServiceName: lineParts[3],
+				ServiceType: lineParts[4],
+				InstanceNum: instanceNum,
+				Color:       color,
+			}
+		}
+	}()
+	stop = func() {
+		ses.Kill(syscall.SIGTERM)
+	}
+	return eventsOut, stop, nil
+}
+
+// Get a container's IP address on each network it's attached to
+func GetContainerIPs(name string) (map[string]string, error) {
+	ses := shellsession.NewSession()
+	ses.Stderr = ioutil.Discard
+	out, err := ses.Command("docker", "inspect", "--type", "container", "--format", "{{json .NetworkSettings.Networks}}", name).Output()
+	if err != nil {
+		return nil, err
+	}
+	var networks map[string]struct {
+		IPAddress string
+	}
+	if err = json.Unmarshal(bytes.TrimSpace(out), &networks); err != nil {
+		return nil, err
+	}
+	ips := make(map[string]string, len(networks))
+	for network, settings := range networks {
+		ips[network] = settings.IPAddress
+	}
+	return ips, nil
+}
+
+// A single sample of a container's resource usage
+type StatsSnapshot struct {
+	Name string
+	// percentage of host cpu
+	CPUPercent float64
+	// bytes
+	MemoryUsage uint64
+	// bytes
+	MemoryLimit   uint64
+	MemoryPercent float64
+	// bytes received
+	NetworkRx uint64
+	// bytes sent
+	NetworkTx uint64
+	// bytes read
+	BlockRead uint64
+	// bytes written
+	BlockWrite uint64
+	PIDs       int
+}
+
+// Take one sample of resource usage for each of the named containers
+func GetStatsSnapshot(names []string) (map[string]*StatsSnapshot, error) {
+	args := []interface{}{
+		"stats",
+		"--no-stream",
+		"--format",
+		"{{.Container}}\t{{.CPUPerc}}\t{{.MemUsage}}\t{{.MemPerc}}\t{{.NetIO}}\t{{.BlockIO}}\t{{.PIDs}}",
+	}
+	out, err := RunCmd(append(args, ToInterfaceSlice(names)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*StatsSnapshot, len(names))
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		lineParts := strings.Split(line, "\t")
+		if len(lineParts) < 7 {
+			continue
+		}
+		snap := &StatsSnapshot{
+			Name: lineParts[0],
+		}
+		snap.CPUPercent, _ = ParsePercent(lineParts[1])
+		snap.MemoryUsage, snap.MemoryLimit = parseSizePair(lineParts[2])
+		snap.MemoryPercent, _ = ParsePercent(lineParts[3])
+		snap.NetworkRx, snap.NetworkTx = parseSizePair(lineParts[4])
+		snap.BlockRead, snap.BlockWrite = parseSizePair(lineParts[5])
+		snap.PIDs, _ = strconv.Atoi(strings.TrimSpace(lineParts[6]))
+		stats[snap.Name] = snap
+	}
+	return stats, nil
+}
+
+// Parse docker's "used / total" columns
+func parseSizePair(pair string) (uint64, uint64) {
+	parts := strings.SplitN(pair, "/", 2)
+	first, _ := ParseSize(parts[0])
+	if len(parts) < 2 {
+		return first, 0
+	}
+	second, _ := ParseSize(parts[1])
+	return first, second
+}
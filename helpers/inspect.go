@@ -0,0 +1,127 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/byrnedo/capitan/shellsession"
+	"io/ioutil"
+)
+
+type PortBinding struct {
+	HostIp   string
+	HostPort string
+}
+
+type RestartPolicy struct {
+	Name              string
+	MaximumRetryCount int
+}
+
+type LogConfig struct {
+	Type   string
+	Config map[string]string
+}
+
+// The parts of `docker inspect` output for a container that capitan uses
+type ContainerInspect struct {
+	ID    string `json:"Id"`
+	Name  string
+	Image string
+	State struct {
+		Running bool
+	}
+	Config struct {
+		Hostname   string
+		User       string
+		Env        []string
+		Cmd        []string
+		Entrypoint []string
+		Image      string
+		WorkingDir string
+		Labels     map[string]string
+	}
+	HostConfig struct {
+		Binds         []string
+		NetworkMode   string
+		PortBindings  map[string][]PortBinding
+		RestartPolicy RestartPolicy
+		VolumesFrom   []string
+		Links         []string
+		CapAdd        []string
+		CapDrop       []string
+		Dns           []string
+		Privileged    bool
+		LogConfig     LogConfig
+	}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string
+			Aliases   []string
+		}
+		// container port, eg. 80/tcp -> where it's published, if it is
+		Ports map[string][]PortBinding
+	}
+}
+
+// The parts of `docker inspect` output for an image that capitan uses
+type ImageInspect struct {
+	ID     string `json:"Id"`
+	Config struct {
+		User       string
+		Env        []string
+		Cmd        []string
+		Entrypoint []string
+		WorkingDir string
+		Labels     map[string]string
+	}
+}
+
+func inspect(objType string, name string, out interface{}) error {
+	ses := shellsession.NewSession()
+	ses.Stderr = ioutil.Discard
+	data, err := ses.Command("docker", "inspect", "--type", objType, name).Output()
+	if err != nil {
+		return errors.New("Failed to inspect " + objType + " " + name + ": " + err.Error())
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Inspect a single container
+func InspectContainer(name string) (*ContainerInspect, error) {
+	var results []*ContainerInspect
+	if err := inspect("container", name, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("No such container: " + name)
+	}
+	return results[0], nil
+}
+
+// Inspect several containers at once
+func InspectContainers(names []string) ([]*ContainerInspect, error) {
+	var results []*ContainerInspect
+	if len(names) == 0 {
+		return results, nil
+	}
+	ses := shellsession.NewSession()
+	ses.Stderr = ioutil.Discard
+	data, err := ses.Command("docker", append([]interface{}{"inspect", "--type", "container"}, ToInterfaceSlice(names)...)...).Output()
+	if err != nil {
+		return nil, errors.New("Failed to inspect containers: " + err.Error())
+	}
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
+// Inspect a single image
+func InspectImage(name string) (*ImageInspect, error) {
+	var results []*ImageInspect
+	if err := inspect("image", name, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("No such image: " + name)
+	}
+	return results[0], nil
+}
@@ -0,0 +1,189 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// The name capitan has always given containers, eg. myproj_app_blue_1
+const DefaultNameTemplate = "{{.Project}}{{.Sep}}{{.Service}}{{.Sep}}{{.Color}}{{.Sep}}{{.Instance}}"
+
+// Names given before blue/green deploys, eg. myproj_app_1
+const LegacyNameTemplate = "{{.Project}}{{.Sep}}{{.Service}}{{.Sep}}{{.Instance}}"
+
+var (
+	DefaultNames = MustNameTemplate(DefaultNameTemplate)
+	LegacyNames  = MustNameTemplate(LegacyNameTemplate)
+
+	validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// How container names are built from the project, service, colour and instance.
+type NameTemplate struct {
+	Text string
+	tmpl *template.Template
+}
+
+// The values a container name is built from
+type NameFields struct {
+	Project  string
+	Service  string
+	Color    string
+	Instance int
+	// the project separator
+	Sep string
+}
+
+func NewNameTemplate(text string) (*NameTemplate, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t := &NameTemplate{Text: text, tmpl: tmpl}
+
+	// every service and instance must get its own name
+	sample := NameFields{Project: "proj", Service: "svc", Color: "blue", Instance: 1, Sep: "_"}
+	name, err := t.execute(sample)
+	if err != nil {
+		return nil, err
+	}
+	if !validContainerName.MatchString(name) {
+		return nil, errors.New("gives an invalid container name: " + name)
+	}
+	other := sample
+	other.Instance = 2
+	if otherName, _ := t.execute(other); otherName == name {
+		return nil, errors.New("must include {{.Instance}}")
+	}
+	other = sample
+	other.Service = "other"
+	if otherName, _ := t.execute(other); otherName == name {
+		return nil, errors.New("must include {{.Service}}")
+	}
+	return t, nil
+}
+
+func MustNameTemplate(text string) *NameTemplate {
+	t, err := NewNameTemplate(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *NameTemplate) execute(fields NameFields) (string, error) {
+	var out bytes.Buffer
+	err := t.tmpl.Execute(&out, map[string]interface{}{
+		"Project":  fields.Project,
+		"Service":  fields.Service,
+		"Color":    fields.Color,
+		"Instance": fields.Instance,
+		"Sep":      fields.Sep,
+	})
+	return out.String(), err
+}
+
+// The container name for the given fields
+func (t *NameTemplate) Name(fields NameFields) string {
+	// can't fail, the template was tried when it was created
+	name, _ := t.execute(fields)
+	return name
+}
+
+// Whether blue and green containers get different names,
+// needed for both to exist during a blue/green deploy
+func (t *NameTemplate) HasColor() bool {
+	fields := NameFields{Project: "proj", Service: "svc", Color: "blue", Instance: 1, Sep: "_"}
+	blue := t.Name(fields)
+	fields.Color = "green"
+	return t.Name(fields) != blue
+}
+
+// The name without the colour, which stays the same between blue/green deploys,
+// eg. myproj_app_1. A separator next to the colour goes with it.
+func (t *NameTemplate) ColorlessName(fields NameFields) string {
+	fields.Color = colorMarker
+	name := t.Name(fields)
+	for i := strings.Index(name, colorMarker); i >= 0; i = strings.Index(name, colorMarker) {
+		start, end := i, i+len(colorMarker)
+		if start > 0 && !isNameAlnum(name[start-1]) {
+			start--
+		} else if end < len(name) && !isNameAlnum(name[end]) {
+			end++
+		}
+		name = name[:start] + name[end:]
+	}
+	return name
+}
+
+func isNameAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// Parse a name with the first of the templates it matches
+func ParseName(name string, project string, sep string, templates ...*NameTemplate) (fields NameFields, err error) {
+	for _, t := range templates {
+		if fields, err = t.Parse(name, project, sep); err == nil {
+			return fields, nil
+		}
+	}
+	return fields, err
+}
+
+// Placeholders which can't appear in a name, used to find where each field is
+const (
+	projectMarker  = "\x00project\x00"
+	serviceMarker  = "\x00service\x00"
+	colorMarker    = "\x00color\x00"
+	instanceMarker = "\x00instance\x00"
+)
+
+// Read the service, colour and instance back out of a container name.
+// Fails if the name wasn't made with this template.
+func (t *NameTemplate) Parse(name string, project string, sep string) (NameFields, error) {
+	fields := NameFields{Project: project, Sep: sep}
+	var out bytes.Buffer
+	if err := t.tmpl.Execute(&out, map[string]interface{}{
+		"Project":  projectMarker,
+		"Service":  serviceMarker,
+		"Color":    colorMarker,
+		"Instance": instanceMarker,
+		"Sep":      sep,
+	}); err != nil {
+		return fields, err
+	}
+	pattern := strings.NewReplacer(
+		regexp.QuoteMeta(projectMarker), regexp.QuoteMeta(project),
+		regexp.QuoteMeta(serviceMarker), `(?P<service>.+?)`,
+		regexp.QuoteMeta(colorMarker), `(?P<color>blue|green)`,
+		regexp.QuoteMeta(instanceMarker), `(?P<instance>[0-9]+)`,
+	).Replace(regexp.QuoteMeta(out.String()))
+	re, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return fields, err
+	}
+
+	match := re.FindStringSubmatch(strings.TrimPrefix(name, "/"))
+	if match == nil {
+		return fields, errors.New("name doesn't match " + t.Text)
+	}
+	// a field used more than once keeps its first value
+	for i, group := range re.SubexpNames() {
+		switch {
+		case group == "service" && fields.Service == "":
+			fields.Service = match[i]
+		case group == "color" && fields.Color == "":
+			fields.Color = match[i]
+		case group == "instance" && fields.Instance == 0:
+			fields.Instance, _ = strconv.Atoi(match[i])
+		}
+	}
+	if fields.Instance == 0 {
+		return fields, errors.New("no instance number in " + name)
+	}
+	return fields, nil
+}
@@ -0,0 +1,123 @@
+package helpers
+
+import (
+	"testing"
+)
+
+func TestNewNameTemplate(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr bool
+	}{
+		{DefaultNameTemplate, false},
+		{LegacyNameTemplate, false},
+		{"{{.Service}}-{{.Instance}}", false},
+		{"{{.Project}}.{{.Service}}.{{.Color}}.{{.Instance}}", false},
+		{"{{.Service}}", true},
+		{"{{.Project}}_{{.Instance}}", true},
+		{"{{.Service}} {{.Instance}}", true},
+		{"_{{.Service}}{{.Instance}}", true},
+		{"{{.Service}}{{.Missing}}{{.Instance}}", true},
+		{"{{.Service", true},
+	}
+	for _, test := range tests {
+		_, err := NewNameTemplate(test.text)
+		if (err != nil) != test.wantErr {
+			t.Errorf("NewNameTemplate(%q) error = %v, want error %v", test.text, err, test.wantErr)
+		}
+	}
+}
+
+func TestNameTemplateParse(t *testing.T) {
+	tests := []struct {
+		text    string
+		name    string
+		want    NameFields
+		wantErr bool
+	}{
+		{DefaultNameTemplate, "proj_web_blue_1", NameFields{Project: "proj", Service: "web", Color: "blue", Instance: 1, Sep: "_"}, false},
+		{DefaultNameTemplate, "/proj_web_green_12", NameFields{Project: "proj", Service: "web", Color: "green", Instance: 12, Sep: "_"}, false},
+		{DefaultNameTemplate, "proj_my_app_blue_3", NameFields{Project: "proj", Service: "my_app", Color: "blue", Instance: 3, Sep: "_"}, false},
+		{LegacyNameTemplate, "proj_web_2", NameFields{Project: "proj", Service: "web", Instance: 2, Sep: "_"}, false},
+		{"{{.Service}}-{{.Instance}}.{{.Project}}", "web-4.proj", NameFields{Project: "proj", Service: "web", Instance: 4, Sep: "_"}, false},
+		{DefaultNameTemplate, "other_web_blue_1", NameFields{}, true},
+		{DefaultNameTemplate, "proj_web_red_1", NameFields{}, true},
+		{DefaultNameTemplate, "proj_web_blue_x", NameFields{}, true},
+		{DefaultNameTemplate, "proj_web_blue_0", NameFields{}, true},
+		{LegacyNameTemplate, "proj_web", NameFields{}, true},
+	}
+	for _, test := range tests {
+		got, err := MustNameTemplate(test.text).Parse(test.name, "proj", "_")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q.Parse(%q) error = %v, want error %v", test.text, test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("%q.Parse(%q) = %+v, want %+v", test.text, test.name, got, test.want)
+		}
+	}
+}
+
+func TestNameTemplateRoundTrip(t *testing.T) {
+	templates := []string{DefaultNameTemplate, LegacyNameTemplate, "{{.Service}}-{{.Color}}-{{.Instance}}", "{{.Project}}{{.Sep}}{{.Instance}}{{.Sep}}{{.Service}}"}
+	fields := NameFields{Project: "proj", Service: "web", Color: "green", Instance: 7, Sep: "-"}
+	for _, text := range templates {
+		tmpl := MustNameTemplate(text)
+		want := fields
+		if !tmpl.HasColor() {
+			want.Color = ""
+		}
+		name := tmpl.Name(fields)
+		got, err := tmpl.Parse(name, fields.Project, fields.Sep)
+		if err != nil {
+			t.Errorf("%q.Parse(%q) error = %v", text, name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q.Parse(%q) = %+v, want %+v", text, name, got, want)
+		}
+	}
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    NameFields
+		wantErr bool
+	}{
+		{"proj_web_blue_1", NameFields{Project: "proj", Service: "web", Color: "blue", Instance: 1, Sep: "_"}, false},
+		{"proj_web_1", NameFields{Project: "proj", Service: "web", Instance: 1, Sep: "_"}, false},
+		{"proj_web", NameFields{}, true},
+		{"web_1", NameFields{}, true},
+	}
+	for _, test := range tests {
+		got, err := ParseName(test.name, "proj", "_", DefaultNames, LegacyNames)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseName(%q) error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("ParseName(%q) = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNameTemplateColorlessName(t *testing.T) {
+	fields := NameFields{Project: "proj", Service: "web", Color: "blue", Instance: 1, Sep: "_"}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{DefaultNameTemplate, "proj_web_1"},
+		{LegacyNameTemplate, "proj_web_1"},
+		{"{{.Color}}-{{.Service}}-{{.Instance}}", "web-1"},
+		{"{{.Service}}-{{.Instance}}-{{.Color}}", "web-1"},
+		{"{{.Service}}{{.Color}}{{.Instance}}", "web1"},
+		{"{{.Service}}.{{.Instance}}", "web.1"},
+	}
+	for _, test := range tests {
+		if got := MustNameTemplate(test.text).ColorlessName(fields); got != test.want {
+			t.Errorf("%q.ColorlessName() = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
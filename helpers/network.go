@@ -0,0 +1,33 @@
+package helpers
+
+import (
+	"github.com/byrnedo/capitan/shellsession"
+	"io/ioutil"
+)
+
+// Create a network unless it exists
+func EnsureNetwork(name string) error {
+	ses := shellsession.NewSession()
+	ses.Stderr = ioutil.Discard
+	if _, err := ses.Command("docker", "network", "inspect", name).Output(); err == nil {
+		return nil
+	}
+	_, err := RunCmd("network", "create", name)
+	return err
+}
+
+// Attach a container to a network, reachable there by each alias
+func ConnectNetwork(network string, container string, aliases ...string) error {
+	args := []interface{}{"network", "connect"}
+	for _, alias := range aliases {
+		args = append(args, "--alias", alias)
+	}
+	_, err := RunCmd(append(args, network, container)...)
+	return err
+}
+
+// Detach a container from a network, its aliases there go with it
+func DisconnectNetwork(network string, container string) error {
+	_, err := RunCmd("network", "disconnect", network, container)
+	return err
+}
@@ -17,3 +17,12 @@ func ToInterfaceSlice(data []string) (out []interface{}) {
 	}
 	return
 }
+
+func StringInSlice(needle string, haystack []string) bool {
+	for _, item := range haystack {
+		if item == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package helpers
 
 import (
+	"bytes"
+	"errors"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -37,12 +39,152 @@ func RandStringBytesMaskImprSrc(n int) string {
 	return string(b)
 }
 
-func GetNumericSuffix(name string, sep string) (int, error) {
-	namePts := strings.Split(name, sep)
-	instNumStr := namePts[len(namePts)-1]
-	return strconv.Atoi(instNumStr)
-}
-
 func HashInterfaceSlice(args []interface{}) string {
 	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("'%s'", args))))
 }
+
+var sizeUnits = map[string]float64{
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1024,
+	"mib": 1024 * 1024,
+	"gib": 1024 * 1024 * 1024,
+	"tib": 1024 * 1024 * 1024 * 1024,
+}
+
+// Parse a human readable size as printed by docker, eg "1.5GiB" or "648B"
+func ParseSize(size string) (uint64, error) {
+	size = strings.TrimSpace(size)
+	i := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(size)
+	}
+	num, err := strconv.ParseFloat(size[:i], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := strings.ToLower(strings.TrimSpace(size[i:]))
+	if unit == "" {
+		unit = "b"
+	}
+	mult, found := sizeUnits[unit]
+	if !found {
+		return 0, errors.New("Unknown size unit: " + unit)
+	}
+	return uint64(num * mult), nil
+}
+
+// Parse a percentage as printed by docker, eg "0.07%"
+func ParsePercent(perc string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(perc), "%"), 64)
+}
+
+// Format a number of bytes for humans, eg "1.5GiB"
+func FormatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	val := float64(size)
+	i := 0
+	for val >= 1024 && i < len(units)-1 {
+		val /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.2f%s", val, units[i])
+}
+
+// Split a line into arguments like bash would, without expanding anything.
+// Whitespace separates arguments, quotes group them and are removed and a backslash
+// escapes the next character outside of single quotes.
+// Template expressions, from {{ to }}, are kept as they are, quotes and all.
+func SplitArgs(line string) ([]string, error) {
+	var (
+		args  []string
+		arg   bytes.Buffer
+		inArg bool
+		quote byte
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quote != '\'' && strings.HasPrefix(line[i:], "{{") {
+			end := templateEnd(line[i:])
+			if end < 0 {
+				return nil, errors.New("unclosed {{")
+			}
+			arg.WriteString(line[i : i+end])
+			inArg = true
+			i += end - 1
+			continue
+		}
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteByte(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+				i++
+				arg.WriteByte(line[i])
+			} else {
+				arg.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\':
+			if i+1 < len(line) {
+				i++
+				arg.WriteByte(line[i])
+			}
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unclosed " + string(quote))
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Length of the template expression the text starts with, up to and including
+// its }}, skipping any in string literals. -1 if it isn't closed.
+func templateEnd(text string) int {
+	var quote byte
+	for i := 2; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '`' || c == '\'':
+			quote = c
+		case strings.HasPrefix(text[i:], "}}"):
+			return i + 2
+		}
+	}
+	return -1
+}
@@ -0,0 +1,89 @@
+package helpers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    uint64
+		wantErr bool
+	}{
+		{size: "648B", want: 648},
+		{size: "0B", want: 0},
+		{size: "12", want: 12},
+		{size: "1.5kB", want: 1500},
+		{size: "1.5KiB", want: 1536},
+		{size: "2MiB", want: 2 * 1024 * 1024},
+		{size: "1.5GiB", want: 1536 * 1024 * 1024},
+		{size: "3.2 MB", want: 3200000},
+		{size: " 1TB ", want: 1000 * 1000 * 1000 * 1000},
+		{size: "1.5XB", wantErr: true},
+		{size: "GiB", wantErr: true},
+		{size: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseSize(test.size)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseSize(%q) error = %v, want error %v", test.size, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", test.size, got, test.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size uint64
+		want string
+	}{
+		{size: 0, want: "0B"},
+		{size: 1023, want: "1023B"},
+		{size: 1024, want: "1.00KiB"},
+		{size: 1536, want: "1.50KiB"},
+		{size: 1536 * 1024 * 1024, want: "1.50GiB"},
+		{size: 5 * 1024 * 1024 * 1024 * 1024 * 1024, want: "5120.00TiB"},
+	}
+	for _, test := range tests {
+		if got := FormatSize(test.size); got != test.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", test.size, got, test.want)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{line: "", want: nil},
+		{line: "  a   b\tc ", want: []string{"a", "b", "c"}},
+		{line: `FOO="a b"`, want: []string{"FOO=a b"}},
+		{line: `'a "b"' c`, want: []string{`a "b"`, "c"}},
+		{line: `"a \"b\" \\ \x"`, want: []string{`a "b" \ \x`}},
+		{line: `a\ b`, want: []string{"a b"}},
+		{line: `""`, want: []string{""}},
+		{line: `tag={{.ImageName}}`, want: []string{"tag={{.ImageName}}"}},
+		{line: `{{printf "%s %s" .Name .Service}} x`, want: []string{`{{printf "%s %s" .Name .Service}}`, "x"}},
+		{line: `{{"{{.Name}}"}}`, want: []string{`{{"{{.Name}}"}}`}},
+		{line: `"a {{.Name}} b"`, want: []string{"a {{.Name}} b"}},
+		{line: `'{{'`, want: []string{"{{"}},
+		{line: `"a`, wantErr: true},
+		{line: `{{.Name`, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := SplitArgs(test.line)
+		if (err != nil) != test.wantErr {
+			t.Errorf("SplitArgs(%q) error = %v, want error %v", test.line, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
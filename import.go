@@ -0,0 +1,539 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Top level key in a compose file holding extra capitan config lines,
+// eg `global blue_green true`, appended after the converted services.
+const composeCapitanExtension = "x-capitan"
+
+type composeImporter struct {
+	lines    []string
+	warnings int
+	// compose project, the prefix of the networks it creates
+	project string
+	// top level networks, by the name services use
+	networks map[interface{}]interface{}
+	// the compose network joined as the global network
+	network string
+}
+
+func (i *composeImporter) warn(service string, format string, args ...interface{}) {
+	i.warnings++
+	Warning.Printf(service+": "+format+"\n", args...)
+}
+
+func (i *composeImporter) add(service string, directive string, args string) {
+	i.lines = append(i.lines, strings.TrimRight(service+" "+directive+" "+args, " "))
+}
+
+// Compose allows most lists to also be given as maps, eg environment
+func composeList(val interface{}, sep string) []string {
+	switch v := val.(type) {
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			list = append(list, composeScalar(item))
+		}
+		return list
+	case map[interface{}]interface{}:
+		list := make([]string, 0, len(v))
+		for key, item := range v {
+			if item == nil {
+				list = append(list, composeScalar(key))
+			} else {
+				list = append(list, composeScalar(key)+sep+composeScalar(item))
+			}
+		}
+		// maps have no order, keep the output stable
+		sort.Strings(list)
+		return list
+	case nil:
+		return nil
+	default:
+		return []string{composeScalar(v)}
+	}
+}
+
+func composeScalar(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Quote an argument so helpers.SplitArgs gives it back unchanged
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// Quote each argument and join them into one line
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// A command given as a string or a list, as a list
+func composeCommand(val interface{}) []string {
+	if cmd, ok := val.(string); ok {
+		args, err := helpers.SplitArgs(cmd)
+		if err != nil {
+			return []string{cmd}
+		}
+		return args
+	}
+	return composeList(val, "")
+}
+
+// Long syntax port, eg {target: 80, published: 8080, protocol: udp}
+func composePort(val interface{}) string {
+	port, ok := val.(map[interface{}]interface{})
+	if !ok {
+		return composeScalar(val)
+	}
+	spec := composeScalar(port["target"])
+	if published := composeScalar(port["published"]); published != "" {
+		spec = published + ":" + spec
+	}
+	if protocol := composeScalar(port["protocol"]); protocol != "" {
+		spec += "/" + protocol
+	}
+	return spec
+}
+
+// Long syntax volume, eg {type: bind, source: ./data, target: /data, read_only: true}
+func composeVolume(val interface{}) string {
+	vol, ok := val.(map[interface{}]interface{})
+	if !ok {
+		return composeScalar(val)
+	}
+	spec := composeScalar(vol["target"])
+	if source := composeScalar(vol["source"]); source != "" {
+		spec = source + ":" + spec
+	}
+	if readOnly, _ := vol["read_only"].(bool); readOnly {
+		spec += ":ro"
+	}
+	return spec
+}
+
+// depends_on is a list, or from 2.1 a map of service to condition
+func composeDependsOn(val interface{}) []string {
+	if deps, ok := val.(map[interface{}]interface{}); ok {
+		names := make([]string, 0, len(deps))
+		for name := range deps {
+			names = append(names, composeScalar(name))
+		}
+		sort.Strings(names)
+		return names
+	}
+	return composeList(val, "")
+}
+
+// Order services so dependencies come first, otherwise keeping file order
+func orderComposeServices(names []string, services map[interface{}]interface{}) ([]string, error) {
+	deps := make(map[string][]string, len(names))
+	for _, name := range names {
+		deps[name] = nil
+		if svc, ok := services[name].(map[interface{}]interface{}); ok {
+			deps[name] = composeDependsOn(svc["depends_on"])
+		}
+	}
+
+	var (
+		ordered  = make([]string, 0, len(names))
+		done     = make(map[string]bool)
+		visiting = make(map[string]bool)
+		visit    func(name string) error
+	)
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return errors.New("depends_on cycle involving " + name)
+		}
+		visiting[name] = true
+		for _, dep := range deps[name] {
+			if _, found := deps[dep]; !found {
+				return errors.New(name + " depends on unknown service " + dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		done[name] = true
+		ordered = append(ordered, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// The compose network a service is on, the first if it has several.
+// Services without any are on the project's `default` network, unless they have a network_mode.
+func composeServiceNetwork(svc map[interface{}]interface{}) (string, bool) {
+	if _, found := svc["network_mode"]; found {
+		return "", false
+	}
+	var networks []string
+	if netMap, ok := svc["networks"].(map[interface{}]interface{}); ok {
+		// map of network to settings, only the names are used
+		for network := range netMap {
+			networks = append(networks, composeScalar(network))
+		}
+		sort.Strings(networks)
+	} else {
+		networks = composeList(svc["networks"], "")
+	}
+	if len(networks) == 0 {
+		return "default", true
+	}
+	return networks[0], true
+}
+
+// The network most services are on, the first one used wins a tie
+func composeProjectNetwork(order []string, services map[interface{}]interface{}) string {
+	var (
+		best  string
+		count = make(map[string]int)
+	)
+	for _, name := range order {
+		svc, _ := services[name].(map[interface{}]interface{})
+		network, ok := composeServiceNetwork(svc)
+		if !ok {
+			continue
+		}
+		count[network]++
+		if count[network] > count[best] {
+			best = network
+		}
+	}
+	return best
+}
+
+// The docker network compose creates for one of the file's networks, `<project>_<network>`
+// unless it's external or given its own name
+func (i *composeImporter) networkName(network string) string {
+	def, _ := i.networks[network].(map[interface{}]interface{})
+	if name := composeScalar(def["name"]); name != "" {
+		return name
+	}
+	switch external := def["external"].(type) {
+	case bool:
+		if external {
+			return network
+		}
+	case map[interface{}]interface{}:
+		// version 2 syntax, external: {name: x}
+		if name := composeScalar(external["name"]); name != "" {
+			return name
+		}
+		return network
+	}
+	return i.project + "_" + network
+}
+
+// Compose's default project name, the directory the file is in, lowercased
+// with anything but letters, digits, '_' and '-' dropped
+func composeDefaultProject(composeFile string) string {
+	dir, err := filepath.Abs(filepath.Dir(composeFile))
+	if err != nil {
+		dir = filepath.Dir(composeFile)
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return -1
+	}, strings.ToLower(filepath.Base(dir)))
+}
+
+func (i *composeImporter) importBuild(name string, val interface{}) {
+	if context, ok := val.(string); ok {
+		i.add(name, "build", context)
+		return
+	}
+	build, ok := val.(map[interface{}]interface{})
+	if !ok {
+		return
+	}
+	context := composeScalar(build["context"])
+	if context == "" {
+		context = "."
+	}
+	i.add(name, "build", context)
+
+	var buildArgs []string
+	if dockerfile := composeScalar(build["dockerfile"]); dockerfile != "" {
+		buildArgs = append(buildArgs, "--file", quoteArg(dockerfile))
+	}
+	for _, arg := range composeList(build["args"], "=") {
+		buildArgs = append(buildArgs, "--build-arg", quoteArg(arg))
+	}
+	if len(buildArgs) > 0 {
+		i.add(name, "build-args", strings.Join(buildArgs, " "))
+	}
+}
+
+func (i *composeImporter) importService(name string, svc map[interface{}]interface{}) {
+	keys := make([]string, 0, len(svc))
+	for key := range svc {
+		keys = append(keys, composeScalar(key))
+	}
+	// image and build first, then the rest in a stable order
+	sort.Slice(keys, func(a, b int) bool {
+		rank := func(key string) int {
+			switch key {
+			case "image":
+				return 0
+			case "build":
+				return 1
+			}
+			return 2
+		}
+		if rank(keys[a]) != rank(keys[b]) {
+			return rank(keys[a]) < rank(keys[b])
+		}
+		return keys[a] < keys[b]
+	})
+
+	for _, key := range keys {
+		val := svc[key]
+		switch key {
+		case "image":
+			i.add(name, "image", composeScalar(val))
+		case "build":
+			i.importBuild(name, val)
+		case "command":
+			// written with the entrypoint
+			if _, found := svc["entrypoint"]; !found {
+				i.add(name, "command", quoteArgs(composeCommand(val)))
+			}
+		case "entrypoint":
+			// --entrypoint only takes the executable, the rest of it goes in front of the command
+			entrypoint := composeCommand(val)
+			if len(entrypoint) > 0 {
+				i.add(name, "entrypoint", quoteArg(entrypoint[0]))
+				entrypoint = entrypoint[1:]
+			}
+			if cmd := append(entrypoint, composeCommand(svc["command"])...); len(cmd) > 0 {
+				i.add(name, "command", quoteArgs(cmd))
+			}
+		case "container_name":
+			i.warn(name, "container_name is ignored, capitan names containers itself")
+		case "hostname", "restart", "user":
+			i.add(name, key, composeScalar(val))
+		case "working_dir":
+			i.add(name, "workdir", quoteArg(composeScalar(val)))
+		case "privileged":
+			if b, _ := val.(bool); b {
+				i.add(name, "privileged", "")
+			}
+		case "environment":
+			for _, env := range composeList(val, "=") {
+				i.add(name, "env", quoteArg(env))
+			}
+		case "env_file":
+			for _, file := range composeList(val, "") {
+				i.add(name, "env-file", quoteArg(file))
+			}
+		case "labels":
+			for _, label := range composeList(val, "=") {
+				i.add(name, "label", quoteArg(label))
+			}
+		case "ports":
+			if ports, ok := val.([]interface{}); ok {
+				for _, port := range ports {
+					i.add(name, "publish", composePort(port))
+				}
+			}
+		case "expose":
+			for _, port := range composeList(val, "") {
+				i.add(name, "expose", port)
+			}
+		case "volumes":
+			if vols, ok := val.([]interface{}); ok {
+				for _, vol := range vols {
+					i.add(name, "volume", quoteArg(composeVolume(vol)))
+				}
+			}
+		case "volumes_from":
+			for _, from := range composeList(val, "") {
+				if strings.HasPrefix(from, "service:") {
+					from = strings.TrimPrefix(from, "service:")
+				} else if strings.HasPrefix(from, "container:") {
+					from = strings.TrimPrefix(from, "container:")
+				}
+				i.add(name, "volumes-from", from)
+			}
+		case "links", "external_links":
+			for _, link := range composeList(val, ":") {
+				i.add(name, "link", link)
+			}
+		case "depends_on":
+			if deps := composeDependsOn(val); len(deps) > 0 {
+				i.add(name, "depends-on", strings.Join(deps, " "))
+			}
+		case "networks":
+			// joined below
+			if networks := composeList(val, ""); len(networks) > 1 {
+				first, _ := composeServiceNetwork(svc)
+				i.warn(name, "only the first network (%s) is used, docker run can only attach one", first)
+			}
+		case "network_mode":
+			i.add(name, "net", composeScalar(val))
+		case "dns":
+			for _, dns := range composeList(val, "") {
+				i.add(name, "dns", dns)
+			}
+		case "cap_add", "cap_drop":
+			for _, capability := range composeList(val, "") {
+				i.add(name, strings.Replace(key, "_", "-", 1), capability)
+			}
+		case "logging":
+			if logging, ok := val.(map[interface{}]interface{}); ok {
+				if driver := composeScalar(logging["driver"]); driver != "" {
+					i.add(name, "log-driver", driver)
+				}
+				for _, opt := range composeList(logging["options"], "=") {
+					i.add(name, "log-opt", quoteArg(opt))
+				}
+			}
+		case "scale":
+			i.add(name, "scale", composeScalar(val))
+		case "profiles":
+			if names := composeList(val, "="); len(names) > 0 {
+				i.add(name, "profile", strings.Join(names, " "))
+			}
+		case "deploy":
+			if deploy, ok := val.(map[interface{}]interface{}); ok {
+				if replicas := composeScalar(deploy["replicas"]); replicas != "" {
+					i.add(name, "scale", replicas)
+				}
+			}
+		default:
+			i.warn(name, "%s is not supported", key)
+		}
+	}
+
+	// the project network is joined through `global network`, capitan doesn't create any other
+	if network, ok := composeServiceNetwork(svc); ok && network != i.network {
+		i.add(name, "net", i.networkName(network))
+		i.warn(name, "network %s must already exist, only the project network (%s) is created", i.networkName(network), i.networkName(i.network))
+	}
+}
+
+// Convert a docker-compose file into capitan config lines.
+// The project name is used for network names when the file doesn't give one.
+func composeToConfig(data []byte, project string) ([]byte, error) {
+	var (
+		file map[string]interface{}
+		// only used for the order services are defined in
+		keyOrder struct {
+			Services yaml.MapSlice `yaml:"services"`
+		}
+	)
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &keyOrder); err != nil {
+		return nil, err
+	}
+
+	services, ok := file["services"].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("No services found, only compose files version 2 and later are supported")
+	}
+	names := make([]string, 0, len(keyOrder.Services))
+	for _, item := range keyOrder.Services {
+		names = append(names, composeScalar(item.Key))
+	}
+
+	order, err := orderComposeServices(names, services)
+	if err != nil {
+		return nil, err
+	}
+
+	importer := &composeImporter{
+		project: project,
+		network: composeProjectNetwork(order, services),
+	}
+	if name := composeScalar(file["name"]); name != "" {
+		importer.project = name
+	}
+	importer.networks, _ = file["networks"].(map[interface{}]interface{})
+	if importer.network != "" {
+		// services reach each other by name there, as they do with compose
+		importer.lines = append(importer.lines, "global network "+importer.networkName(importer.network))
+	}
+	for _, name := range order {
+		svc, _ := services[name].(map[interface{}]interface{})
+		importer.lines = append(importer.lines, "", "# "+name)
+		importer.importService(name, svc)
+	}
+	if extraConf := composeList(file[composeCapitanExtension], ""); len(extraConf) > 0 {
+		importer.lines = append(importer.lines, "")
+		importer.lines = append(importer.lines, extraConf...)
+	}
+	if importer.warnings > 0 {
+		Warning.Printf("%d compose options could not be imported\n", importer.warnings)
+	}
+	return []byte(strings.TrimLeft(strings.Join(importer.lines, "\n"), "\n") + "\n"), nil
+}
+
+// Wrap config in a script suitable for the default --cmd
+func configToScript(conf []byte) []byte {
+	return []byte("#!/bin/bash\n\ncat <<'EOF'\n" + string(conf) + "EOF\n")
+}
+
+// Convert a docker-compose file to capitan config, written to stdout or out
+func CapitanImport(composeFile string, script bool, out string) error {
+	if composeFile == "" {
+		return errors.New("No compose file given")
+	}
+	data, err := ioutil.ReadFile(composeFile)
+	if err != nil {
+		return err
+	}
+	conf, err := composeToConfig(data, composeDefaultProject(composeFile))
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if script {
+		conf = configToScript(conf)
+		mode = 0755
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(conf)
+		return err
+	}
+	return ioutil.WriteFile(out, conf, mode)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderComposeServices(t *testing.T) {
+	dependsOn := func(deps ...interface{}) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"depends_on": deps}
+	}
+	tests := []struct {
+		name     string
+		names    []string
+		services map[interface{}]interface{}
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "file order kept",
+			names:    []string{"b", "a", "c"},
+			services: map[interface{}]interface{}{"a": nil, "b": nil, "c": nil},
+			want:     []string{"b", "a", "c"},
+		},
+		{
+			name:     "dependency moved first",
+			names:    []string{"web", "db"},
+			services: map[interface{}]interface{}{"web": dependsOn("db"), "db": nil},
+			want:     []string{"db", "web"},
+		},
+		{
+			name:  "depends_on map",
+			names: []string{"web", "cache", "db"},
+			services: map[interface{}]interface{}{
+				"web":   map[interface{}]interface{}{"depends_on": map[interface{}]interface{}{"db": map[interface{}]interface{}{"condition": "service_healthy"}}},
+				"cache": nil,
+				"db":    nil,
+			},
+			want: []string{"db", "web", "cache"},
+		},
+		{
+			name:     "chain",
+			names:    []string{"a", "b", "c"},
+			services: map[interface{}]interface{}{"a": dependsOn("b"), "b": dependsOn("c"), "c": nil},
+			want:     []string{"c", "b", "a"},
+		},
+		{
+			name:     "cycle",
+			names:    []string{"a", "b"},
+			services: map[interface{}]interface{}{"a": dependsOn("b"), "b": dependsOn("a")},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown dependency",
+			names:    []string{"a"},
+			services: map[interface{}]interface{}{"a": dependsOn("missing")},
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		got, err := orderComposeServices(test.names, test.services)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestComposeToConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		compose string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "image, ports and env",
+			compose: `
+version: "3"
+services:
+  web:
+    image: nginx:latest
+    ports:
+      - "8080:80"
+    environment:
+      GREETING: hello world
+      MODE: prod
+`,
+			want: `global network proj_default
+
+# web
+web image nginx:latest
+web env "GREETING=hello world"
+web env MODE=prod
+web publish 8080:80
+`,
+		},
+		{
+			name: "services ordered by depends_on",
+			compose: `
+version: "2"
+services:
+  web:
+    image: app
+    depends_on:
+      - db
+  db:
+    image: postgres
+`,
+			want: `global network proj_default
+
+# db
+db image postgres
+
+# web
+web image app
+web depends-on db
+`,
+		},
+		{
+			name: "command and entrypoint",
+			compose: `
+version: "3"
+services:
+  worker:
+    image: app
+    entrypoint: ["/bin/sh", "-c"]
+    command: echo "a b"
+  job:
+    image: app
+    command: ["run", "--name", "my job"]
+`,
+			want: `global network proj_default
+
+# worker
+worker image app
+worker entrypoint /bin/sh
+worker command -c echo "a b"
+
+# job
+job image app
+job command run --name "my job"
+`,
+		},
+		{
+			name: "build and volumes",
+			compose: `
+version: "3"
+services:
+  app:
+    build:
+      context: ./app
+      dockerfile: Dockerfile.dev
+      args:
+        - VERSION=1
+    volumes:
+      - ./data:/data
+      - type: bind
+        source: ./conf
+        target: /etc/conf
+        read_only: true
+`,
+			want: `global network proj_default
+
+# app
+app build ./app
+app build-args --file Dockerfile.dev --build-arg VERSION=1
+app volume ./data:/data
+app volume ./conf:/etc/conf:ro
+`,
+		},
+		{
+			name: "capitan extension",
+			compose: `
+version: "3"
+services:
+  app:
+    image: app
+x-capitan:
+  - app blue-green true
+`,
+			want: `global network proj_default
+
+# app
+app image app
+
+app blue-green true
+`,
+		},
+		{
+			name: "networks",
+			compose: `
+version: "3"
+services:
+  web:
+    image: nginx
+    networks: [front, back]
+  api:
+    image: app
+    networks:
+      front:
+        aliases: [api]
+  db:
+    image: postgres
+    networks: [back]
+  cache:
+    image: redis
+  tool:
+    image: tool
+    network_mode: host
+networks:
+  front:
+  back:
+    external: true
+`,
+			want: `global network proj_front
+
+# web
+web image nginx
+
+# api
+api image app
+
+# db
+db image postgres
+db net back
+
+# cache
+cache image redis
+cache net proj_default
+
+# tool
+tool image tool
+tool net host
+`,
+		},
+		{
+			name: "project name from the file",
+			compose: `
+version: "3"
+name: shop
+services:
+  web:
+    image: nginx
+    networks: [shop]
+networks:
+  shop:
+    name: shop-net
+`,
+			want: `global network shop-net
+
+# web
+web image nginx
+`,
+		},
+		{
+			name:    "version 1",
+			compose: "app:\n  image: app\n",
+			wantErr: true,
+		},
+		{
+			name:    "depends_on cycle",
+			compose: "version: \"2\"\nservices:\n  a:\n    depends_on: [b]\n  b:\n    depends_on: [a]\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := composeToConfig([]byte(test.compose), "proj")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && string(got) != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestComposeDefaultProject(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"/srv/shop/docker-compose.yml", "shop"},
+		{"/srv/My Shop/docker-compose.yml", "myshop"},
+		{"/srv/web_app-2/compose.yaml", "web_app-2"},
+	}
+	for _, test := range tests {
+		if got := composeDefaultProject(test.file); got != test.want {
+			t.Errorf("composeDefaultProject(%q) = %q, want %q", test.file, got, test.want)
+		}
+	}
+}
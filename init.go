@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byrnedo/capitan/consts"
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Generates config which reproduces containers started outside of capitan
+type containerImporter struct {
+	lines []string
+}
+
+func (i *containerImporter) add(service string, directive string, args string) {
+	i.lines = append(i.lines, strings.TrimRight(service+" "+directive+" "+args, " "))
+}
+
+// Service name for a container, its name without the leading slash
+func serviceNameForContainer(ctr *helpers.ContainerInspect) string {
+	name := strings.TrimPrefix(ctr.Name, "/")
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '#' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Items in list which aren't in defaults
+func withoutDefaults(list []string, defaults []string) []string {
+	var out []string
+	for _, item := range list {
+		if !helpers.StringInSlice(item, defaults) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func (i *containerImporter) importContainer(service string, ctr *helpers.ContainerInspect, image *helpers.ImageInspect) {
+	i.add(service, "image", ctr.Config.Image)
+
+	// skip anything the image already sets
+	if !reflect.DeepEqual(ctr.Config.Entrypoint, image.Config.Entrypoint) && len(ctr.Config.Entrypoint) > 0 {
+		// --entrypoint only takes the executable, the rest of it goes in front of
+		// the command. Overriding it also drops the image's command so always write that.
+		i.add(service, "entrypoint", quoteArg(ctr.Config.Entrypoint[0]))
+		cmd := append(append([]string{}, ctr.Config.Entrypoint[1:]...), ctr.Config.Cmd...)
+		if len(cmd) > 0 {
+			i.add(service, "command", quoteArgs(cmd))
+		}
+	} else if !reflect.DeepEqual(ctr.Config.Cmd, image.Config.Cmd) && len(ctr.Config.Cmd) > 0 {
+		i.add(service, "command", quoteArgs(ctr.Config.Cmd))
+	}
+	// docker defaults the hostname to the short id
+	if ctr.Config.Hostname != "" && !strings.HasPrefix(ctr.ID, ctr.Config.Hostname) {
+		i.add(service, "hostname", ctr.Config.Hostname)
+	}
+	if ctr.Config.User != "" && ctr.Config.User != image.Config.User {
+		i.add(service, "user", ctr.Config.User)
+	}
+	if ctr.Config.WorkingDir != "" && ctr.Config.WorkingDir != image.Config.WorkingDir {
+		i.add(service, "workdir", quoteArg(ctr.Config.WorkingDir))
+	}
+	for _, env := range withoutDefaults(ctr.Config.Env, image.Config.Env) {
+		i.add(service, "env", quoteArg(env))
+	}
+
+	labels := make([]string, 0, len(ctr.Config.Labels))
+	for key, val := range ctr.Config.Labels {
+		if strings.HasPrefix(key, "capitan") {
+			continue
+		}
+		if imageVal, found := image.Config.Labels[key]; found && imageVal == val {
+			continue
+		}
+		labels = append(labels, key+"="+val)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		i.add(service, "label", quoteArg(label))
+	}
+
+	ports := make([]string, 0, len(ctr.HostConfig.PortBindings))
+	for containerPort, bindings := range ctr.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			spec := containerPort
+			if binding.HostPort != "" {
+				spec = binding.HostPort + ":" + spec
+			}
+			if binding.HostIp != "" {
+				spec = binding.HostIp + ":" + spec
+			}
+			ports = append(ports, strings.TrimSuffix(spec, "/tcp"))
+		}
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		i.add(service, "publish", port)
+	}
+
+	for _, bind := range ctr.HostConfig.Binds {
+		i.add(service, "volume", quoteArg(bind))
+	}
+	for _, from := range ctr.HostConfig.VolumesFrom {
+		i.add(service, "volumes-from", from)
+	}
+	for _, link := range ctr.HostConfig.Links {
+		// stored as /other:/this/alias
+		linkParts := strings.SplitN(link, ":", 2)
+		target := strings.TrimPrefix(linkParts[0], "/")
+		if len(linkParts) == 2 {
+			target += ":" + linkParts[1][strings.LastIndex(linkParts[1], "/")+1:]
+		}
+		i.add(service, "link", target)
+	}
+
+	netMode := ctr.HostConfig.NetworkMode
+	if netMode != "" && netMode != "default" && netMode != "bridge" {
+		i.add(service, "net", netMode)
+	}
+	for network := range ctr.NetworkSettings.Networks {
+		if network != netMode && !(network == "bridge" && (netMode == "default" || netMode == "")) {
+			Warning.Printf("%s: also attached to network %s, docker run can only attach one\n", service, network)
+		}
+	}
+
+	switch policy := ctr.HostConfig.RestartPolicy; policy.Name {
+	case "", "no":
+	case "on-failure":
+		if policy.MaximumRetryCount > 0 {
+			i.add(service, "restart", fmt.Sprintf("on-failure:%d", policy.MaximumRetryCount))
+		} else {
+			i.add(service, "restart", "on-failure")
+		}
+	default:
+		i.add(service, "restart", policy.Name)
+	}
+
+	if ctr.HostConfig.Privileged {
+		i.add(service, "privileged", "")
+	}
+	for _, capability := range ctr.HostConfig.CapAdd {
+		i.add(service, "cap-add", capability)
+	}
+	for _, capability := range ctr.HostConfig.CapDrop {
+		i.add(service, "cap-drop", capability)
+	}
+	for _, dns := range ctr.HostConfig.Dns {
+		i.add(service, "dns", dns)
+	}
+	if logConf := ctr.HostConfig.LogConfig; logConf.Type != "" && logConf.Type != "json-file" {
+		i.add(service, "log-driver", logConf.Type)
+		opts := make([]string, 0, len(logConf.Config))
+		for key, val := range logConf.Config {
+			opts = append(opts, key+"="+val)
+		}
+		sort.Strings(opts)
+		for _, opt := range opts {
+			i.add(service, "log-opt", quoteArg(opt))
+		}
+	}
+}
+
+// Generate config reproducing the given containers.
+// With adopt the containers are renamed to what capitan would call them, docker can't add
+// capitan's labels to an existing container so the name is what makes them part of the project.
+func CapitanInitFromContainers(names []string, projName string, adopt bool, dryRun bool, script bool, out string) error {
+	if len(names) == 0 {
+		return errors.New("No containers given")
+	}
+
+	importer := &containerImporter{}
+	if projName != "" {
+		importer.lines = append(importer.lines, "global project "+projName)
+	} else {
+		projName = defaultProjectName()
+	}
+
+	// current name -> name capitan will give it
+	renames := make([][2]string, 0, len(names))
+
+	for _, name := range names {
+		ctr, err := helpers.InspectContainer(name)
+		if err != nil {
+			return err
+		}
+		if ctr.Config.Labels[consts.ProjectLabelName] != "" {
+			Warning.Printf("%s is already managed by capitan project %s\n", name, ctr.Config.Labels[consts.ProjectLabelName])
+		}
+		image, err := helpers.InspectImage(ctr.Image)
+		if err != nil {
+			return err
+		}
+
+		service := serviceNameForContainer(ctr)
+		importer.lines = append(importer.lines, "", "# "+service)
+		importer.importContainer(service, ctr, image)
+
+		newCtr := &container.Container{
+			ProjectName:          projName,
+			ServiceType:          service,
+			ServiceName:          projName + defaultProjectSeparator + service,
+			ProjectNameSeparator: defaultProjectSeparator,
+			InstanceNumber:       1,
+			State:                &helpers.ServiceState{Color: "blue"},
+		}
+		newCtr.NewName()
+		renames = append(renames, [2]string{strings.TrimPrefix(ctr.Name, "/"), newCtr.Name})
+	}
+
+	conf := []byte(strings.TrimLeft(strings.Join(importer.lines, "\n"), "\n") + "\n")
+	mode := os.FileMode(0644)
+	if script {
+		conf = configToScript(conf)
+		mode = 0755
+	}
+	if out == "" {
+		if _, err := os.Stdout.Write(conf); err != nil {
+			return err
+		}
+	} else if err := ioutil.WriteFile(out, conf, mode); err != nil {
+		return err
+	}
+
+	if !adopt {
+		Warning.Printf("Stop and remove %s, then run `capitan up` to recreate them under capitan, or use --adopt to keep them\n", strings.Join(names, ", "))
+		return nil
+	}
+	for _, rename := range renames {
+		oldName, newName := rename[0], rename[1]
+		if newName == oldName {
+			continue
+		}
+		Info.Printf("Adopting %s as %s\n", oldName, newName)
+		if dryRun {
+			continue
+		}
+		if err := helpers.RenameContainer(oldName, newName); err != nil {
+			return errors.New("Failed to rename " + oldName + ": " + err.Error())
+		}
+	}
+	return nil
+}
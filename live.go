@@ -0,0 +1,197 @@
+package main
+
+import (
+	. "github.com/byrnedo/capitan/consts"
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A service's running containers, as found in docker rather than the config
+type LiveService struct {
+	// the service in the config, eg. app
+	Name string `json:"name"`
+	// colour of the live containers
+	Color string `json:"color"`
+	// the lowest published container port, eg. 80, empty if none are published
+	Port      string          `json:"port,omitempty"`
+	Instances []*LiveInstance `json:"instances"`
+}
+
+// Whether any instance has an address, a proxy has nothing to send to otherwise
+func (svc *LiveService) HasIP() bool {
+	for _, instance := range svc.Instances {
+		if instance.IP != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// A running container of a service
+type LiveInstance struct {
+	Name     string `json:"name"`
+	Instance int    `json:"instance"`
+	Color    string `json:"color"`
+	// address on the project network if there is one, otherwise on the first network
+	IP string `json:"ip"`
+	// network name -> ip address
+	IPs   map[string]string `json:"ips"`
+	Ports []*LivePort       `json:"ports"`
+}
+
+// A published container port
+type LivePort struct {
+	// container port, eg. 80
+	Port string `json:"port"`
+	// tcp or udp
+	Proto    string `json:"proto"`
+	HostIP   string `json:"hostIp"`
+	HostPort string `json:"hostPort"`
+}
+
+// The project's running containers grouped by service, sorted by name and instance.
+// Containers in exclude are left out, eg. ones about to be removed.
+func (settings *ProjectConfig) liveServices(exclude SettingsList) ([]*LiveService, error) {
+	ids, err := helpers.RunningProjectContainers(settings.ProjectName)
+	if err != nil {
+		return nil, err
+	}
+	inspects, err := helpers.InspectContainers(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[string]bool, len(exclude))
+	for _, set := range exclude {
+		excluded[set.Name] = true
+	}
+
+	byName := make(map[string]*LiveService)
+	var services []*LiveService
+	for _, ins := range inspects {
+		name := strings.TrimPrefix(ins.Name, "/")
+		if excluded[name] || !ins.State.Running {
+			continue
+		}
+		labels := ins.Config.Labels
+		svcType := labels[ServiceLabelType]
+		if svcType == "" {
+			svcType = strings.TrimPrefix(labels[ServiceLabelName], settings.ProjectName+settings.ProjectSeparator)
+		}
+		if svcType == "" {
+			continue
+		}
+		instance, _ := strconv.Atoi(labels[ContainerNumberLabelName])
+		color := labels[ColorLabelName]
+		if color == "" {
+			color = "blue"
+		}
+
+		live := &LiveInstance{
+			Name:     name,
+			Instance: instance,
+			Color:    color,
+			IPs:      make(map[string]string),
+		}
+		var networks []string
+		for network, netSettings := range ins.NetworkSettings.Networks {
+			if netSettings.IPAddress != "" {
+				live.IPs[network] = netSettings.IPAddress
+				networks = append(networks, network)
+			}
+		}
+		sort.Strings(networks)
+		if ip, found := live.IPs[settings.Network]; found {
+			live.IP = ip
+		} else if len(networks) > 0 {
+			live.IP = live.IPs[networks[0]]
+		}
+		live.Ports = livePorts(ins.NetworkSettings.Ports)
+
+		svc := byName[svcType]
+		if svc == nil {
+			svc = &LiveService{Name: svcType}
+			byName[svcType] = svc
+			services = append(services, svc)
+		}
+		svc.Instances = append(svc.Instances, live)
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	for _, svc := range services {
+		instances := svc.Instances
+		sort.Slice(instances, func(i, j int) bool {
+			if instances[i].Instance != instances[j].Instance {
+				return instances[i].Instance < instances[j].Instance
+			}
+			return instances[i].Color < instances[j].Color
+		})
+		svc.Color = svc.Instances[0].Color
+		for _, instance := range svc.Instances {
+			for _, port := range instance.Ports {
+				if svc.Port == "" || portLess(port.Port, svc.Port) {
+					svc.Port = port.Port
+				}
+			}
+		}
+	}
+	return services, nil
+}
+
+// The published ports, one per host port
+func livePorts(bindings map[string][]helpers.PortBinding) []*LivePort {
+	var (
+		ports = []*LivePort{}
+		seen  = make(map[string]bool)
+	)
+	for private, hosts := range bindings {
+		portProto := strings.SplitN(private, "/", 2)
+		proto := "tcp"
+		if len(portProto) > 1 {
+			proto = portProto[1]
+		}
+		for _, host := range hosts {
+			key := private + ">" + host.HostPort
+			if host.HostPort == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			ports = append(ports, &LivePort{
+				Port:     portProto[0],
+				Proto:    proto,
+				HostIP:   host.HostIp,
+				HostPort: host.HostPort,
+			})
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return portLess(ports[i].Port, ports[j].Port)
+		}
+		return ports[i].HostPort < ports[j].HostPort
+	})
+	return ports
+}
+
+func portLess(a string, b string) bool {
+	aNum, aErr := strconv.Atoi(a)
+	bNum, bErr := strconv.Atoi(b)
+	if aErr != nil || bErr != nil {
+		return a < b
+	}
+	return aNum < bNum
+}
+
+// Point the proxy and discovery files at the new container during a blue/green cutover, before the old one stops
+func (settings *ProjectConfig) cutover(old *container.Container) error {
+	if err := settings.updateProxy(SettingsList{old}, false); err != nil {
+		return err
+	}
+	settings.refreshDiscovery(SettingsList{old}, false)
+	return nil
+}
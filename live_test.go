@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/helpers"
+	"reflect"
+	"testing"
+)
+
+func TestLivePorts(t *testing.T) {
+	tests := []struct {
+		name     string
+		bindings map[string][]helpers.PortBinding
+		want     []*LivePort
+	}{
+		{
+			name: "nothing published",
+			want: []*LivePort{},
+		},
+		{
+			name: "unpublished skipped",
+			bindings: map[string][]helpers.PortBinding{
+				"80/tcp":  {{HostIp: "0.0.0.0", HostPort: "8080"}},
+				"443/tcp": {{HostIp: "", HostPort: ""}},
+			},
+			want: []*LivePort{{Port: "80", Proto: "tcp", HostIP: "0.0.0.0", HostPort: "8080"}},
+		},
+		{
+			name: "one per host port",
+			bindings: map[string][]helpers.PortBinding{
+				"80/tcp": {{HostIp: "0.0.0.0", HostPort: "8080"}, {HostIp: "::", HostPort: "8080"}},
+			},
+			want: []*LivePort{{Port: "80", Proto: "tcp", HostIP: "0.0.0.0", HostPort: "8080"}},
+		},
+		{
+			name: "sorted by port number then host port",
+			bindings: map[string][]helpers.PortBinding{
+				"8080/tcp": {{HostPort: "9000"}},
+				"53/udp":   {{HostPort: "5353"}},
+				"443":      {{HostPort: "8443"}, {HostPort: "443"}},
+			},
+			want: []*LivePort{
+				{Port: "53", Proto: "udp", HostPort: "5353"},
+				{Port: "443", Proto: "tcp", HostPort: "443"},
+				{Port: "443", Proto: "tcp", HostPort: "8443"},
+				{Port: "8080", Proto: "tcp", HostPort: "9000"},
+			},
+		},
+	}
+	for _, test := range tests {
+		got := livePorts(test.bindings)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: livePorts() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPortLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"80", "443", true},
+		{"443", "80", false},
+		{"80", "80", false},
+		{"9", "10", true},
+		{"http", "80", false},
+		{"80", "http", true},
+	}
+	for _, test := range tests {
+		if got := portLess(test.a, test.b); got != test.want {
+			t.Errorf("portLess(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long to keep following once nothing is streaming, a recreated container
+// can take a while to start again (pulls, ready checks, hooks)
+const logFollowGrace = 30 * time.Second
+
+// Keeps the 'logs' command attached to a project while its containers come and go,
+// eg. during a blue/green redeploy or a scale from another terminal.
+type logFollower struct {
+	opts container.LogOptions
+	// new containers are only followed if they match
+	filter ContainerFilter
+	// service type -> a definition to copy for containers we didn't know about
+	templates map[string]*container.Container
+	// container name -> container whose log is being streamed
+	streaming map[string]*container.Container
+	lock      sync.Mutex
+	wg        sync.WaitGroup
+	projName  string
+	// stops following once it fires, armed while nothing is streaming
+	idleTimer *time.Timer
+	// closed once nothing has been streamed for logFollowGrace
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newLogFollower(settings SettingsList, opts container.LogOptions, filter ContainerFilter, projName string) *logFollower {
+	f := &logFollower{
+		opts:      opts,
+		filter:    filter,
+		templates: make(map[string]*container.Container),
+		streaming: make(map[string]*container.Container),
+		projName:  projName,
+		done:      make(chan struct{}),
+	}
+	for _, set := range settings {
+		if _, found := f.templates[set.ServiceType]; !found {
+			f.templates[set.ServiceType] = set
+		}
+	}
+	return f
+}
+
+// Start streaming a container's log unless it's already being streamed
+func (f *logFollower) attach(set *container.Container, opts container.LogOptions) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, found := f.streaming[set.Name]; found {
+		return false
+	}
+	f.streaming[set.Name] = set
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+		f.idleTimer = nil
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		if err := set.Logs(opts); err != nil {
+			Error.Println("Error getting log for " + set.Name + ": " + err.Error())
+		}
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		delete(f.streaming, set.Name)
+		if len(f.streaming) == 0 && f.idleTimer == nil {
+			f.idleTimer = time.AfterFunc(logFollowGrace, f.finishIfIdle)
+		}
+	}()
+	return true
+}
+
+// Finish following if no container has started since the last stream ended
+func (f *logFollower) finishIfIdle() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.streaming) > 0 {
+		return
+	}
+	f.doneOnce.Do(func() {
+		close(f.done)
+	})
+}
+
+// Find another container being streamed for the same service instance
+func (f *logFollower) replacing(set *container.Container) *container.Container {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, other := range f.streaming {
+		if other.Name != set.Name && other.ServiceType == set.ServiceType && other.InstanceNumber == set.InstanceNumber {
+			return other
+		}
+	}
+	return nil
+}
+
+func (f *logFollower) handleEvent(ev *helpers.ContainerEvent) {
+	tmpl, found := f.templates[ev.ServiceType]
+	if !found {
+		return
+	}
+
+	switch ev.Action {
+	case "start":
+		set := new(container.Container)
+		*set = *tmpl
+		set.Name = ev.Name
+		set.InstanceNumber = ev.InstanceNum
+		set.State = &helpers.ServiceState{
+			Name:        ev.Name,
+			ServiceName: ev.ServiceName,
+			InstanceNum: ev.InstanceNum,
+			Color:       ev.Color,
+			Running:     true,
+		}
+		if !f.filter.Match(set) {
+			return
+		}
+
+		old := f.replacing(set)
+
+		// only what this run of the container has logged
+		opts := f.opts
+		opts.Tail = "all"
+		opts.Since = strconv.FormatInt(ev.Time, 10)
+		if !f.attach(set, opts) {
+			return
+		}
+		if old != nil {
+			ContainerInfoLog(set.Name, "--- now following, replaces "+old.Name+" ---")
+		} else {
+			ContainerInfoLog(set.Name, "--- now following ---")
+		}
+	case "die":
+		f.lock.Lock()
+		_, found := f.streaming[ev.Name]
+		f.lock.Unlock()
+		if found {
+			ContainerInfoLog(ev.Name, "--- container stopped, no longer following ---")
+		}
+	}
+}
+
+// Stream the logs of the given containers, then keep following the project,
+// attaching to any new instances or colours of the same services as they start.
+// Returns when the event stream ends, or once nothing has been streamed for logFollowGrace.
+func (f *logFollower) Run(settings SettingsList) {
+	events, stop, err := helpers.ProjectContainerEvents(f.projName)
+	if err != nil {
+		Warning.Println("Unable to watch for container changes, only following current containers:", err)
+	}
+
+	for _, set := range settings {
+		f.attach(set, f.opts)
+	}
+
+	for events != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			f.handleEvent(ev)
+		case <-f.done:
+			stop()
+			events = nil
+		}
+	}
+	f.wg.Wait()
+}
@@ -12,6 +12,8 @@ import (
 type ContainerLogWriter struct {
 	*log.Logger
 	colorCode []byte
+	// partial line carried over between writes
+	buf []byte
 }
 
 var (
@@ -29,10 +31,30 @@ func NewContainerLogWriter(out io.Writer, containerName string, color string) *C
 	}
 }
 
+// Prints each complete line with the container prefix.
+// A trailing partial line is held back until the rest of it arrives
+// or Flush is called.
 func (w *ContainerLogWriter) Write(b []byte) (int, error) {
-	toPrint := bytes.Split(bytes.Trim(b, "\n"), []byte{'\n'})
-	for _, line := range toPrint {
-		w.Printf("%s%s%s", w.colorCode, line, resetCode)
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.printLine(w.buf[:i])
+		w.buf = w.buf[i+1:]
 	}
 	return len(b), nil
 }
+
+// Print any partial line still held in the buffer
+func (w *ContainerLogWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.printLine(w.buf)
+	}
+	w.buf = nil
+}
+
+func (w *ContainerLogWriter) printLine(line []byte) {
+	w.Printf("%s%s%s", w.colorCode, bytes.TrimRight(line, "\r"), resetCode)
+}
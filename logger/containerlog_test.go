@@ -0,0 +1,44 @@
+package logger
+
+import (
+	"bytes"
+	"github.com/mgutz/ansi"
+	"testing"
+)
+
+func TestContainerLogWriter(t *testing.T) {
+	prefix := ansi.Color("app| ", "blue")
+	line := func(text string) string {
+		return prefix + ansi.ColorCode("blue") + text + ansi.ColorCode("reset") + "\n"
+	}
+	tests := []struct {
+		name   string
+		writes []string
+		flush  bool
+		want   string
+	}{
+		{name: "one line", writes: []string{"hello\n"}, want: line("hello")},
+		{name: "several lines", writes: []string{"a\nb\n"}, want: line("a") + line("b")},
+		{name: "split line", writes: []string{"hel", "lo\nwor", "ld\n"}, want: line("hello") + line("world")},
+		{name: "partial held back", writes: []string{"a\nb"}, want: line("a")},
+		{name: "partial flushed", writes: []string{"a\nb"}, flush: true, want: line("a") + line("b")},
+		{name: "carriage return", writes: []string{"a\r\n"}, want: line("a")},
+		{name: "empty line", writes: []string{"\n"}, want: line("")},
+	}
+	for _, test := range tests {
+		LongestContainerName = 3
+		var out bytes.Buffer
+		w := NewContainerLogWriter(&out, "app", "blue")
+		for _, write := range test.writes {
+			if n, err := w.Write([]byte(write)); err != nil || n != len(write) {
+				t.Fatalf("%s: Write(%q) = %d, %v", test.name, write, n, err)
+			}
+		}
+		if test.flush {
+			w.Flush()
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, out.String(), test.want)
+		}
+	}
+}
@@ -1,19 +1,41 @@
 package main
 
 import (
+	"errors"
 	"github.com/byrnedo/capitan/container"
 	. "github.com/byrnedo/capitan/logger"
 	"github.com/codegangsta/cli"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var (
-	command    string
-	args       []string
-	verboseLog bool
-	dryRun     bool
-	attach     bool
-	filter     string
+	command       string
+	args          []string
+	verboseLog    bool
+	dryRun        bool
+	attach        bool
+	filter        string
+	ctrFilter     ContainerFilter
+	logOpts       container.LogOptions
+	noFollow      bool
+	output        string
+	psAll         bool
+	statsNoStream bool
+	exportFormat  string
+	exportVersion string
+	exportOut     string
+	configFile    string
+	profiles      []string
+	importScript  bool
+	importOut     string
+
+	initFromContainers string
+	initProject        string
+	initAdopt          bool
+	initScript         bool
+	initOut            string
 )
 
 func main() {
@@ -42,9 +64,25 @@ func main() {
 		cli.StringFlag{
 			Name:        "filter,f",
 			Value:       "",
-			Usage:       "Filter to run action on a specific container only",
+			Usage:       "Only act on these containers, eg. app, 'worker-*', app:2, app@green, label=k=v (comma separated)",
 			Destination: &filter,
 		},
+		cli.StringFlag{
+			Name:        "file",
+			Usage:       "Read config from a file instead of --cmd, docker-compose files (.yml/.yaml) are converted",
+			Destination: &configFile,
+		},
+		cli.StringSliceFlag{
+			Name:   "profile",
+			Usage:  "Include services in this profile, can be repeated",
+			EnvVar: "CAPITAN_PROFILES",
+		},
+		cli.StringFlag{
+			Name:        "output,o",
+			Value:       OutputText,
+			Usage:       "Output format for ps, ip, show, status, stats and graph: text, json or yaml",
+			Destination: &output,
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -52,6 +90,29 @@ func main() {
 			SetDebug()
 		}
 
+		switch output {
+		case OutputText:
+		case OutputJSON, OutputYAML:
+			// keep stdout clean for the report
+			Warning.SetOutput(os.Stderr)
+		default:
+			return errors.New("Unknown output format: " + output)
+		}
+
+		var err error
+		if ctrFilter, err = ParseContainerFilter(filter); err != nil {
+			return err
+		}
+
+		// allow comma separated lists as well, as the env var is given
+		for _, profile := range c.StringSlice("profile") {
+			for _, name := range strings.Split(profile, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					profiles = append(profiles, name)
+				}
+			}
+		}
+
 		if dryRun {
 			Info.Printf("Previewing changes...\n\n")
 		}
@@ -77,13 +138,18 @@ func main() {
 				if !settings.RunHook("before.up") {
 					os.Exit(1)
 				}
+				if err := settings.updateProxy(settings.ContainerCleanupList, dryRun); err != nil {
+					Error.Println("Proxy update failed:", err)
+					os.Exit(1)
+				}
 				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
 					Warning.Println("Failed to scale down containers:", err)
 				}
-				if err := settings.ContainerList.CapitanUp(attach, dryRun); err != nil {
+				err := settings.ContainerList.CapitanUp(attach, dryRun)
+				if err != nil {
 					Error.Println("Up failed:", err)
-					os.Exit(1)
 				}
+				settings.afterChange(dryRun, err != nil)
 				if !settings.RunHook("after.up") {
 					os.Exit(1)
 				}
@@ -108,9 +174,6 @@ func main() {
 				if !settings.RunHook("before.create") {
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
-					Warning.Println("Failed to scale down containers:", err)
-				}
 				if err := settings.ContainerList.CapitanCreate(dryRun); err != nil {
 					Error.Println("Create failed:", err)
 					os.Exit(1)
@@ -131,13 +194,11 @@ func main() {
 				if !settings.RunHook("before.start") {
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
-					Warning.Println("Failed to scale down containers:", err)
-				}
-				if err := settings.ContainerList.CapitanStart(attach, dryRun); err != nil {
+				err := settings.ContainerList.CapitanStart(attach, dryRun)
+				if err != nil {
 					Error.Println("Start failed:", err)
-					os.Exit(1)
 				}
+				settings.afterChange(dryRun, err != nil)
 				if !settings.RunHook("after.start") {
 					os.Exit(1)
 				}
@@ -159,20 +220,27 @@ func main() {
 			SkipFlagParsing: true,
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
+				settings.LaunchSignalWatcher()
 				if !settings.RunHook("before.scale") {
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.Filter(func(i *container.Container) bool {
+				scaledDown := settings.ContainerCleanupList.Filter(func(i *container.Container) bool {
 					return i.ServiceType == c.Args().Get(0)
-				}).CapitanRm([]string{"-f"}, dryRun); err != nil {
+				})
+				if err := settings.updateProxy(scaledDown, dryRun); err != nil {
+					Error.Println("Proxy update failed:", err)
+					os.Exit(1)
+				}
+				if err := scaledDown.CapitanRm([]string{"-f"}, dryRun); err != nil {
 					Warning.Println("Failed to scale down containers:", err)
 				}
-				if err := settings.ContainerList.Filter(func(i *container.Container) bool {
+				err := settings.ContainerList.Filter(func(i *container.Container) bool {
 					return i.ServiceType == c.Args().Get(0)
-				}).CapitanUp(false, dryRun); err != nil {
+				}).CapitanUp(false, dryRun)
+				if err != nil {
 					Error.Println("Scale failed:", err)
-					os.Exit(1)
 				}
+				settings.afterChange(dryRun, err != nil)
 				if !settings.RunHook("after.scale") {
 					os.Exit(1)
 				}
@@ -189,13 +257,11 @@ func main() {
 				if !settings.RunHook("before.restart") {
 					os.Exit(1)
 				}
-				if err := settings.ContainerCleanupList.CapitanRm([]string{"-f"}, dryRun); err != nil {
-					Warning.Println("Failed to scale down containers:", err)
-				}
-				if err := settings.ContainerList.CapitanRestart(c.Args(), dryRun); err != nil {
+				err := settings.ContainerList.CapitanRestart(c.Args(), dryRun)
+				if err != nil {
 					Error.Println("Restart failed:", err)
-					os.Exit(1)
 				}
+				settings.afterChange(dryRun, err != nil)
 				if !settings.RunHook("after.restart") {
 					os.Exit(1)
 				}
@@ -213,10 +279,11 @@ func main() {
 					os.Exit(1)
 				}
 				combined := append(settings.ContainerList, settings.ContainerCleanupList...)
-				if err := combined.CapitanStop(c.Args(), dryRun); err != nil {
+				err := combined.CapitanStop(c.Args(), dryRun)
+				if err != nil {
 					Error.Println("Stop failed:", err)
-					os.Exit(1)
 				}
+				settings.afterChange(dryRun, err != nil)
 				if !settings.RunHook("after.stop") {
 					os.Exit(1)
 				}
@@ -235,10 +302,11 @@ func main() {
 					os.Exit(1)
 				}
 				combined := append(settings.ContainerList, settings.ContainerCleanupList...)
-				if err := combined.CapitanKill(c.Args(), dryRun); err != nil {
+				err := combined.CapitanKill(c.Args(), dryRun)
+				if err != nil {
 					Error.Println("Kill failed:", err)
-					os.Exit(1)
 				}
+				settings.afterChange(dryRun, err != nil)
 				if !settings.RunHook("after.kill") {
 					os.Exit(1)
 				}
@@ -256,10 +324,11 @@ func main() {
 					os.Exit(1)
 				}
 				combined := append(settings.ContainerList, settings.ContainerCleanupList...)
-				if err := combined.CapitanRm(c.Args(), dryRun); err != nil {
+				err := combined.CapitanRm(c.Args(), dryRun)
+				if err != nil {
 					Error.Println("Rm failed:", err)
-					os.Exit(1)
 				}
+				settings.afterChange(dryRun, err != nil)
 				if !settings.RunHook("after.rm") {
 					os.Exit(1)
 				}
@@ -267,19 +336,25 @@ func main() {
 			},
 		},
 		{
-			Name:            "ps",
-			Aliases:         []string{},
-			Usage:           "Show container status",
-			SkipFlagParsing: true,
+			Name:    "ps",
+			Aliases: []string{},
+			Usage:   "Show container status",
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
-				if err := settings.CapitanPs(c.Args()); err != nil {
+				if err := settings.CapitanPs(psAll, output); err != nil {
 					Error.Println("Ps failed:", err)
 					os.Exit(1)
 				}
 
 				return nil
 			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "all,a",
+					Usage:       "Include orphaned containers, whose service is no longer in the config",
+					Destination: &psAll,
+				},
+			},
 		},
 		{
 			Name:            "ip",
@@ -288,13 +363,28 @@ func main() {
 			SkipFlagParsing: true,
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
-				if err := settings.ContainerList.CapitanIP(); err != nil {
+				if err := settings.ContainerList.CapitanIP(output); err != nil {
 					Error.Println("IP failed:", err)
 					os.Exit(1)
 				}
 				return nil
 			},
 		},
+		{
+			Name:    "status",
+			Aliases: []string{},
+			Usage:   "Check whether containers match the config, exits non-zero if not",
+			Action: func(c *cli.Context) error {
+				settings := getSettings()
+				code, err := settings.CapitanStatus(output)
+				if err != nil {
+					Error.Println("Status failed:", err)
+					os.Exit(1)
+				}
+				os.Exit(code)
+				return nil
+			},
+		},
 		{
 			Name:    "build",
 			Aliases: []string{},
@@ -328,18 +418,60 @@ func main() {
 			},
 		},
 		{
-			Name:    "logs",
-			Aliases: []string{},
-			Usage:   "stream container logs",
+			Name:      "logs",
+			Aliases:   []string{},
+			Usage:     "stream container logs",
+			ArgsUsage: "[SERVICE...]",
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
+				if logOpts.Tail != "all" {
+					if _, err := strconv.Atoi(logOpts.Tail); err != nil {
+						Error.Println("Logs failed: --tail must be a number or 'all'")
+						os.Exit(1)
+					}
+				}
+				logOpts.Follow = !noFollow
+
 				combined := append(settings.ContainerList, settings.ContainerCleanupList...)
-				if err := combined.CapitanLogs(); err != nil {
+				combined, err := combined.FilterServiceTypes(c.Args())
+				if err != nil {
+					Error.Println("Logs failed:", err)
+					os.Exit(1)
+				}
+				if err := combined.CapitanLogs(logOpts, ctrFilter); err != nil {
 					Error.Println("Logs failed:", err)
 					os.Exit(1)
 				}
 				return nil
 			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "since",
+					Usage:       "Show logs since timestamp or relative time (e.g. 42m)",
+					Destination: &logOpts.Since,
+				},
+				cli.StringFlag{
+					Name:        "until",
+					Usage:       "Show logs before timestamp or relative time (e.g. 42m)",
+					Destination: &logOpts.Until,
+				},
+				cli.StringFlag{
+					Name:        "tail",
+					Value:       "10",
+					Usage:       "Number of lines to show from the end of the logs, or 'all'",
+					Destination: &logOpts.Tail,
+				},
+				cli.BoolFlag{
+					Name:        "timestamps,t",
+					Usage:       "Show timestamps",
+					Destination: &logOpts.Timestamps,
+				},
+				cli.BoolFlag{
+					Name:        "no-follow",
+					Usage:       "Print the logs and exit instead of streaming",
+					Destination: &noFollow,
+				},
+			},
 		},
 		{
 			Name:    "stats",
@@ -348,12 +480,160 @@ func main() {
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
 				combined := append(settings.ContainerList, settings.ContainerCleanupList...)
-				if err := combined.CapitanStats(); err != nil {
+				if err := combined.CapitanStats(statsNoStream, output); err != nil {
 					Error.Println("Stats failed:", err)
 					os.Exit(1)
 				}
 				return nil
 			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "no-stream",
+					Usage:       "Take a single sample and sum it up per service",
+					Destination: &statsNoStream,
+				},
+			},
+		},
+		{
+			Name:    "graph",
+			Aliases: []string{},
+			Usage:   "Print the service dependency graph in DOT format, or json/yaml with --output",
+			Action: func(c *cli.Context) error {
+				// keep stdout clean for the graph
+				Warning.SetOutput(os.Stderr)
+				settings := getSettings()
+				if err := settings.CapitanGraph(output); err != nil {
+					Error.Println("Graph failed:", err)
+					os.Exit(1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "export",
+			Aliases: []string{},
+			Usage:   "Convert the config to another format, currently only docker-compose",
+			Action: func(c *cli.Context) error {
+				if exportOut == "" {
+					// keep stdout clean for the exported file
+					Warning.SetOutput(os.Stderr)
+				}
+				settings := getSettings()
+				if err := settings.CapitanExport(exportFormat, exportVersion, exportOut); err != nil {
+					Error.Println("Export failed:", err)
+					os.Exit(1)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "format",
+					Value:       "compose",
+					Usage:       "Format to export to, only 'compose' is supported",
+					Destination: &exportFormat,
+				},
+				cli.StringFlag{
+					Name:        "compose-version",
+					Value:       "2.2",
+					Usage:       "Compose file version to write, 2.x or 3.x",
+					Destination: &exportVersion,
+				},
+				cli.StringFlag{
+					Name:        "out",
+					Usage:       "File to write to instead of stdout",
+					Destination: &exportOut,
+				},
+			},
+		},
+		{
+			Name:    "init",
+			Aliases: []string{},
+			Usage:   "Generate config from existing containers",
+			Action: func(c *cli.Context) error {
+				if initOut == "" {
+					// keep stdout clean for the config
+					Warning.SetOutput(os.Stderr)
+				}
+				if initFromContainers == "" {
+					Error.Println("Init failed: --from-containers is required")
+					os.Exit(1)
+				}
+				names := strings.Split(initFromContainers, ",")
+				if err := CapitanInitFromContainers(names, initProject, initAdopt, dryRun, initScript, initOut); err != nil {
+					Error.Println("Init failed:", err)
+					os.Exit(1)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "from-containers",
+					Usage:       "Comma separated containers to generate config for",
+					Destination: &initFromContainers,
+				},
+				cli.StringFlag{
+					Name:        "project",
+					Usage:       "Project name to set in the config, defaults to the current directory",
+					Destination: &initProject,
+				},
+				cli.BoolFlag{
+					Name:        "adopt",
+					Usage:       "Rename the containers to the names capitan gives them, so they're kept as they are",
+					Destination: &initAdopt,
+				},
+				cli.BoolFlag{
+					Name:        "script",
+					Usage:       "Wrap the config in a bash script, suitable for the default --cmd",
+					Destination: &initScript,
+				},
+				cli.StringFlag{
+					Name:        "out",
+					Usage:       "File to write to instead of stdout",
+					Destination: &initOut,
+				},
+			},
+		},
+		{
+			Name:      "import",
+			Aliases:   []string{},
+			Usage:     "Convert a docker-compose file to capitan config",
+			ArgsUsage: "COMPOSE_FILE",
+			Action: func(c *cli.Context) error {
+				if importOut == "" {
+					// keep stdout clean for the config
+					Warning.SetOutput(os.Stderr)
+				}
+				if err := CapitanImport(c.Args().First(), importScript, importOut); err != nil {
+					Error.Println("Import failed:", err)
+					os.Exit(1)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "script",
+					Usage:       "Wrap the config in a bash script, suitable for the default --cmd",
+					Destination: &importScript,
+				},
+				cli.StringFlag{
+					Name:        "out",
+					Usage:       "File to write to instead of stdout",
+					Destination: &importOut,
+				},
+			},
+		},
+		{
+			Name:    "migrate",
+			Aliases: []string{},
+			Usage:   "Rename containers made by older versions, or before a name_template change, to their current names",
+			Action: func(c *cli.Context) error {
+				settings := getSettings()
+				if err := settings.CapitanMigrate(dryRun); err != nil {
+					Error.Println("Migrate failed:", err)
+					os.Exit(1)
+				}
+				return nil
+			},
 		},
 		{
 			Name:    "show",
@@ -361,7 +641,7 @@ func main() {
 			Usage:   "Prints config as interpreted by Capitan",
 			Action: func(c *cli.Context) error {
 				settings := getSettings()
-				if err := settings.CapitanShow(); err != nil {
+				if err := settings.CapitanShow(output); err != nil {
 					Error.Println("Show failed:", err)
 					os.Exit(1)
 				}
@@ -376,7 +656,7 @@ func getSettings() (settings *ProjectConfig) {
 	var (
 		err error
 	)
-	runner := NewSettingsParser(command, args, filter)
+	runner := NewSettingsParser(command, args, ctrFilter, configFile, profiles)
 	if settings, err = runner.Run(); err != nil {
 		Error.Printf("Error running command: %s\n", err)
 		os.Exit(1)
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A container whose name or labels don't match what capitan now gives it
+type migration struct {
+	Container *container.Container
+	// current name, the config's name is Container.Name
+	From string
+	// why it can't be renamed, if it can't
+	Conflict string
+}
+
+func (m *migration) needsRename() bool {
+	return m.From != m.Container.Name
+}
+
+// Find the config's containers which exist under another name or without all of capitan's labels
+func (settings *ProjectConfig) migrations() []*migration {
+	list := settings.ContainerList
+	sort.Sort(list)
+	var migrations []*migration
+	for _, set := range list {
+		if set.State.ID == "" {
+			continue
+		}
+		m := &migration{Container: set, From: set.State.Name}
+		if !m.needsRename() && len(set.State.MissingLabels) == 0 {
+			continue
+		}
+		if m.needsRename() && helpers.ContainerExists(set.Name) {
+			m.Conflict = set.Name + " already exists"
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations
+}
+
+// Rename the project's containers to the names the config gives them,
+// so they are kept by the next 'up' instead of being recreated.
+// Labels can't be added to a container, those missing them are only reported.
+func (settings *ProjectConfig) CapitanMigrate(dryRun bool) error {
+	migrations := settings.migrations()
+	if len(migrations) == 0 {
+		Info.Println("Nothing to migrate")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tRENAME TO\tNOTES")
+	for _, m := range migrations {
+		renameTo := "-"
+		if m.needsRename() {
+			renameTo = m.Container.Name
+		}
+		var notes []string
+		if m.Conflict != "" {
+			notes = append(notes, "can't rename, "+m.Conflict)
+		}
+		if len(m.Container.State.MissingLabels) > 0 {
+			notes = append(notes, "missing labels "+strings.Join(m.Container.State.MissingLabels, ", ")+", recreate to add them")
+		}
+		if len(notes) == 0 {
+			notes = append(notes, "-")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", m.From, renameTo, strings.Join(notes, "; "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if dryRun {
+		return nil
+	}
+	for _, m := range migrations {
+		if !m.needsRename() || m.Conflict != "" {
+			continue
+		}
+		if err := helpers.RenameContainer(m.From, m.Container.Name); err != nil {
+			return errors.New(fmt.Sprintf("Failed to rename %s: %s", m.From, err))
+		}
+		m.Container.State.Name = m.Container.Name
+		ContainerInfoLog(m.Container.Name, "Renamed from "+m.From)
+	}
+	return nil
+}
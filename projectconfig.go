@@ -1,17 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"github.com/byrnedo/capitan/consts"
 	"github.com/byrnedo/capitan/container"
 	"github.com/byrnedo/capitan/helpers"
 	. "github.com/byrnedo/capitan/logger"
-	"github.com/codeskyblue/go-sh"
 	"os"
 	"os/signal"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
 	"text/template"
 	"github.com/byrnedo/capitan/shellsession"
 )
@@ -36,8 +38,11 @@ const containerShowTemplate = `{{.Name}}:
   Type:  {{.ServiceType}}
   Image: {{.Image}}{{if .Build}}
   Build: {{.Build}}{{end}}
-  Order: {{.Placement}}
-  Blue/Green Mode: {{.BlueGreenMode}}
+  Order: {{.Placement}}{{if .Profiles}}
+  Profiles: {{range $ind, $val := .Profiles}}{{if $ind}}, {{end}}{{$val}}{{end}}{{end}}
+  Blue/Green Mode: {{.BlueGreenMode}}{{if .StableName}}
+  Stable Name: {{.StableName}} ({{.CanonicalName}}){{end}}{{if .Network}}
+  Network: {{.Network}}{{end}}
   Links: {{range $ind, $link := .Links}}
     {{$link.Container}}{{if $link.Alias}}:{{$link.Alias}}{{end}}{{end}}
   Hooks: {{range $key, $val := .Hooks}}
@@ -54,17 +59,36 @@ const containerShowTemplate = `{{.Name}}:
 
 var (
 	allDone = make(chan bool, 1)
+	// set to 1 once an interrupt has been received
+	interrupted int32
+	// held while a container is being changed so an interrupt
+	// doesn't act on it half way through
+	changeLock sync.Mutex
 )
 
+var errInterrupted = errors.New("interrupted")
+
 type ProjectConfig struct {
 	ProjectName          string
 	ProjectSeparator     string
+	// how container names are built
+	NameTemplate *helpers.NameTemplate
+	// network every container joins, with its service name as an alias
+	Network string
+	// reverse proxy config kept up to date with the containers, if set
+	Proxy *ProxyConfig
+	// files listing the running containers, if set
+	Discovery            *DiscoveryConfig
 	BlueGreenMode	     bool
 	IsInteractive        bool
 	ContainersState	     []*helpers.ServiceState
 	ContainerList        SettingsList
 	ContainerCleanupList SettingsList
-	Hooks 		     Hooks
+	// one definition of every enabled service, whatever the profiles and filter
+	ServiceList SettingsList
+	// containers in the project which aren't in the config
+	OrphanList SettingsList
+	Hooks      Hooks
 }
 
 type Hook struct {
@@ -115,13 +139,10 @@ func (s SettingsList) Swap(i, j int) {
 }
 func (s SettingsList) Less(i, j int) bool {
 	if s[i].Placement == s[j].Placement {
-		iSuf, iErr := helpers.GetNumericSuffix(s[i].Name, s[i].ProjectNameSeparator)
-		jSuf, jErr := helpers.GetNumericSuffix(s[j].Name, s[i].ProjectNameSeparator)
-		if iErr == nil && jErr == nil {
-			return iSuf < jSuf
-		} else {
-			return sort.StringsAreSorted([]string{s[i].Name, s[j].Name})
+		if s[i].InstanceNumber != s[j].InstanceNumber {
+			return s[i].InstanceNumber < s[j].InstanceNumber
 		}
+		return sort.StringsAreSorted([]string{s[i].Name, s[j].Name})
 	}
 	return s[i].Placement < s[j].Placement
 }
@@ -136,15 +157,28 @@ func (s SettingsList) Filter(cb func(*container.Container) bool) (filtered Setti
 	return
 }
 
+// Watches for interrupts for the lifetime of the command.
+//
+// When attached (interactive) the first interrupt stops the project's
+// containers in reverse order, letting docker honour each container's stop
+// timeout, a second interrupt kills them and a third exits immediately.
+//
+// When not attached the first interrupt lets the container currently being
+// changed finish (or roll back) and then aborts the command, a second
+// interrupt exits immediately.
+//
+// Docker commands are run in their own process group from here on so that
+// an interrupt from the terminal reaches capitan alone.
 func (settings *ProjectConfig) LaunchSignalWatcher() {
 
 	var (
 		killBegan     = make(chan bool, 1)
 		killDone      = make(chan bool, 1)
 		stopDone      = make(chan bool, 1)
-		signalChannel = make(chan os.Signal)
+		signalChannel = make(chan os.Signal, 1)
 	)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	shellsession.IsolateInterrupts()
 
 	go func() {
 
@@ -167,43 +201,109 @@ func (settings *ProjectConfig) LaunchSignalWatcher() {
 	}()
 
 	go func() {
-//		var calls int
+		var calls int
 		for {
 			sig := <-signalChannel
 			switch sig {
 			case os.Interrupt, syscall.SIGTERM:
-
-				for _, con := range append(settings.ContainerCleanupList, settings.ContainerList...) {
-					for _, hooks := range con.Hooks {
-						if hooks.Ses != nil {
-							Debug.Println("killing hook...")
-							hooks.Ses.Kill(syscall.SIGKILL)
-						}
+				calls++
+				atomic.StoreInt32(&interrupted, 1)
+
+				if settings.IsInteractive {
+					settings.killHooks()
+					// work on a copy, the list is still being walked by the command
+					halt := make(SettingsList, len(settings.ContainerList))
+					copy(halt, settings.ContainerList)
+					if calls == 1 {
+						Info.Println("Stopping containers, interrupt again to kill them...")
+						go func() {
+							// wait for any container mid change to settle
+							changeLock.Lock()
+							defer changeLock.Unlock()
+							halt.haltAll(false)
+							stopDone <- true
+						}()
+					} else if calls == 2 {
+						killBegan <- true
+						Info.Println("Killing containers, interrupt again to exit immediately...")
+						go func() {
+							halt.haltAll(true)
+							killDone <- true
+						}()
+					} else {
+						exitNow()
+					}
+				} else {
+					// the current container's hooks are part of finishing it
+					if calls == 1 {
+						Warning.Println("Interrupted, finishing current container before exiting. Interrupt again to exit immediately.")
+					} else {
+						settings.killHooks()
+						exitNow()
 					}
 				}
-//				if settings.IsInteractive {
-//					calls++
-//					if calls == 1 {
-//						go func() {
-//							settings.ContainerList.CapitanStop(nil, false)
-//							stopDone <- true
-//						}()
-//					} else if calls == 2 {
-//						killBegan <- true
-//						settings.ContainerList.CapitanKill(nil, false)
-//						killDone <- true
-//					}
-//				} else {
-					os.Exit(1)
-//				}
 			default:
 				Debug.Println("Unhandled signal", sig)
 			}
 		}
-		Info.Println("Done cleaning up")
 	}()
 }
 
+// Exit without waiting for anything, the commands capitan started get the interrupt it took for them
+func exitNow() {
+	Warning.Println("Exiting immediately, project may be left in an inconsistent state")
+	shellsession.InterruptAll()
+	os.Exit(1)
+}
+
+// Kill any hook scripts currently running
+func (settings *ProjectConfig) killHooks() {
+	for _, hook := range settings.Hooks {
+		if hook.Ses != nil {
+			Debug.Println("killing hook...")
+			hook.Ses.Kill(syscall.SIGKILL)
+		}
+	}
+	for _, con := range append(settings.ContainerCleanupList, settings.ContainerList...) {
+		for _, hook := range con.Hooks {
+			if hook.Ses != nil {
+				Debug.Println("killing hook...")
+				hook.Ses.Kill(syscall.SIGKILL)
+			}
+		}
+	}
+}
+
+// Whether an interrupt has been received
+func wasInterrupted() bool {
+	return atomic.LoadInt32(&interrupted) == 1
+}
+
+// Stop or kill every running container in reverse order.
+// Unlike CapitanStop/CapitanKill this carries on past failures so that
+// one misbehaving container doesn't leave the rest running.
+// Stopping and killing can overlap, so neither touches the containers' state,
+// docker is asked which are running and hooks aren't run (they were just killed).
+func (settings SettingsList) haltAll(kill bool) {
+	sort.Sort(sort.Reverse(settings))
+	for _, set := range settings {
+		if !helpers.ContainerIsRunning(set.Name) {
+			continue
+		}
+		var err error
+		if kill {
+			ContainerInfoLog(set.Name, "Killing...")
+			_, err = helpers.RunCmd("kill", set.Name)
+		} else {
+			ContainerInfoLog(set.Name, "Stopping...")
+			_, err = helpers.RunCmd("stop", set.Name)
+		}
+		if err != nil {
+			Warning.Println("Failed to halt "+set.Name+":", err)
+		}
+	}
+}
+
 func (settings *ProjectConfig) RunHook(hookName string) bool {
 	if err:= settings.Hooks.Run(hookName,settings); err != nil {
 		Error.Println("Hook failed:", err)
@@ -212,28 +312,95 @@ func (settings *ProjectConfig) RunHook(hookName string) bool {
 	return true
 }
 
-func (settings *ProjectConfig) CapitanPs(args []string) error {
+// Bring the proxy config and discovery files up to date after a command changed containers.
+// They're refreshed even if it failed, some containers may have changed before it did.
+// Exits if it failed or the proxy couldn't be updated.
+func (settings *ProjectConfig) afterChange(dryRun bool, failed bool) {
+	proxyOk := settings.refreshProxy(dryRun)
+	settings.refreshDiscovery(nil, dryRun)
+	if failed || !proxyOk {
+		os.Exit(1)
+	}
+}
 
-	allArgs := append([]interface{}{"ps"}, helpers.ToInterfaceSlice(args)...)
-	allArgs = append(allArgs, "-f", fmt.Sprintf("label=%s=%s", consts.ProjectLabelName, settings.ProjectName))
+// Show the state of every container in the project, and how it differs from the config
+func (settings *ProjectConfig) CapitanPs(all bool, format string) error {
+	reports := newPsReports(settings, all)
+	if isStructuredOutput(format) {
+		return printStructured(format, reports)
+	}
 
-	var (
-		err error
-		out []byte
-	)
-	if out, err = helpers.RunCmd(allArgs...); err != nil {
-		return err
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSERVICE\tINSTANCE\tCOLOUR\tSTATE\tUPTIME\tPORTS\tDRIFT")
+	for _, report := range reports {
+		uptime := "-"
+		if report.State == StateRunning {
+			uptime = strings.TrimPrefix(report.Status, "Up ")
+		}
+		drift := report.DriftReason
+		if drift == DriftNone {
+			drift = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			report.Name,
+			report.Service,
+			report.Instance,
+			report.Colour,
+			report.State,
+			uptime,
+			strings.Join(report.Ports, ", "),
+			drift,
+		)
+	}
+	return w.Flush()
+}
+
+// Compare the project's containers with the config.
+// Returns the exit code to use, one of the Status* values.
+func (settings *ProjectConfig) CapitanStatus(format string) (int, error) {
+	report := newStatusReport(settings)
+	if isStructuredOutput(format) {
+		return report.ExitCode, printStructured(format, report)
 	}
-	Info.Print(string(out))
-	return nil
 
+	for _, ctr := range report.Containers {
+		switch {
+		case ctr.Drift:
+			ContainerInfoLog(ctr.Name, ctr.DriftReason)
+		case ctr.State == StateStopped:
+			ContainerInfoLog(ctr.Name, "stopped")
+		}
+	}
+	Info.Printf("%s: %s (%d pending, %d down, %d orphaned)\n", settings.ProjectName, report.Result, report.Pending, report.Down, report.Orphans)
+	return report.ExitCode, nil
 }
 
-func (settings *ProjectConfig) CapitanShow() error {
+// Print the service dependency graph, in DOT unless a machine readable format is asked for
+func (settings *ProjectConfig) CapitanGraph(format string) error {
+	graph := newGraph(settings)
+	for _, edge := range graph.Edges {
+		if edge.OutOfOrder {
+			Warning.Printf("%s is started before %s, which it depends on (%s)\n", edge.From, edge.To, edge.Kind)
+		}
+	}
+	if isStructuredOutput(format) {
+		return printStructured(format, graph)
+	}
+	return graph.WriteDot(os.Stdout)
+}
+
+func (settings *ProjectConfig) CapitanShow(format string) error {
 	var (
 		tmpl *template.Template
 		err  error
 	)
+	if isStructuredOutput(format) {
+		report, err := newShowReport(settings)
+		if err != nil {
+			return err
+		}
+		return printStructured(format, report)
+	}
 	if tmpl, err = template.New("projectStringer").Parse(projectShowTemplate); err != nil {
 		return err
 	}
@@ -253,15 +420,17 @@ func newerImage(container string, image string) bool {
 	return false
 }
 
-func haveArgsChanged(container string, runArgs []interface{}) bool {
-
-	uniqueLabel := helpers.HashInterfaceSlice(runArgs)
-	if helpers.GetContainerUniqueLabel(container) != uniqueLabel {
+func haveArgsChanged(set *container.Container) bool {
+	if !set.ArgsUpToDate(helpers.GetContainerUniqueLabel(set.Name)) {
 		return true
 	}
-	return false
-	// remove and restart
-
+	// the addresses from `env-from-service` aren't in the hash
+	changed, err := set.ServiceEnvsChanged()
+	if err != nil {
+		Warning.Printf("Failed to check the service addresses of %s: %s\n", set.Name, err)
+		return false
+	}
+	return changed
 }
 
 
@@ -308,106 +477,146 @@ func (settings SettingsList) CapitanCreate(dryRun bool) error {
 func (settings SettingsList) CapitanUp(attach bool, dryRun bool) error {
 	sort.Sort(settings)
 
-	wg := sync.WaitGroup{}
+	var (
+		wg      = sync.WaitGroup{}
+		aborted bool
+	)
 
 	for _, set := range settings {
-		var (
-			err error
-		)
-
-		if set.Build != "" {
-			ContainerInfoLog(set.Name, "Building image...")
-			if ! dryRun {
-				if err := set.BuildImage(); err != nil {
-					return err
-				}
-			}
+		if wasInterrupted() {
+			aborted = true
+			break
 		}
 
-		if helpers.GetImageId(set.Image) == "" {
-			Warning.Printf("Capitan was unable to find image %s locally\n", set.Image)
-
-			ContainerInfoLog(set.Name, "Pulling image...")
-
-			if ! dryRun {
-				if err := helpers.PullImage(set.Image); err != nil {
-					return err
-				}
-			}
+		changeLock.Lock()
+		err := upContainer(set, attach, dryRun, &wg)
+		changeLock.Unlock()
+		if err != nil {
+			return err
 		}
+	}
+	wg.Wait()
+	if !dryRun && attach && wasInterrupted() {
+		<-allDone
+	}
+	// stopped by an interrupt while attached counts as a failure too
+	if aborted || wasInterrupted() {
+		return errInterrupted
+	}
+	return nil
+}
 
-		//create new
-		if !helpers.ContainerExists(set.Name) {
-			if err = set.Run(attach, dryRun, &wg); err != nil {
+// Bring a single container up to date, used by the 'up' command
+func upContainer(set *container.Container, attach bool, dryRun bool, wg *sync.WaitGroup) error {
+	var (
+		err error
+	)
+
+	if set.Build != "" {
+		ContainerInfoLog(set.Name, "Building image...")
+		if !dryRun {
+			if err := set.BuildImage(); err != nil {
 				return err
 			}
-			continue
 		}
+	}
 
-		// disabling as this doesn't work with swarm (how do I know which node to look at??)
-		//		if newerImage(set.Name, set.Image) {
-		//			// remove and restart
-		//			Info.Println("Removing (different image available):", set.Name)
-		//			if err = set.RecreateAndRun(attach, dryRun, &wg); err != nil {
-		//				return err
-		//			}
-		//
-		//			continue
-		//		}
-
-		if haveArgsChanged(set.Name, set.GetRunArguments()) {
-			// remove and restart
-			if set.BlueGreenMode == container.BGModeOn {
-				ContainerInfoLog(set.Name, "Run arguments changed, doing blue-green redeploy...")
-				if err = set.BlueGreenDeploy(attach, dryRun, &wg); err != nil {
-					return err
-				}
-			} else {
-				ContainerInfoLog(set.Name, "Removing (run arguments changed)")
-				if err = set.RecreateAndRun(attach, dryRun, &wg); err != nil {
-					return err
-				}
+	if helpers.GetImageId(set.Image) == "" {
+		Warning.Printf("Capitan was unable to find image %s locally\n", set.Image)
+
+		ContainerInfoLog(set.Name, "Pulling image...")
+
+		if !dryRun {
+			if err := helpers.PullImage(set.Image); err != nil {
+				return err
 			}
-			continue
 		}
+	}
 
-		//attach if running
-		if set.State.Running {
-			ContainerInfoLog(set.Name, "Already running.")
-			if attach {
-				ContainerInfoLog(set.Name, "Attaching")
-				if err := set.Attach(&wg); err != nil {
-					return err
-				}
+	// the instance exists under another name, eg. the name template changed
+	if set.State.ID != "" && set.State.Name != "" && set.State.Name != set.Name && !helpers.ContainerExists(set.Name) {
+		ContainerInfoLog(set.Name, "Renaming "+set.State.Name+" (name changed)")
+		if !dryRun {
+			if err = helpers.RenameContainer(set.State.Name, set.Name); err != nil {
+				return err
 			}
-			continue
+			set.State.Name = set.Name
 		}
+	}
 
-		ContainerInfoLog(set.Name, "Starting...")
+	//create new
+	if !helpers.ContainerExists(set.Name) {
+		return set.Run(attach, dryRun, wg)
+	}
 
-		if dryRun {
-			continue
+	// disabling as this doesn't work with swarm (how do I know which node to look at??)
+	//		if newerImage(set.Name, set.Image) {
+	//			// remove and restart
+	//			Info.Println("Removing (different image available):", set.Name)
+	//			if err = set.RecreateAndRun(attach, dryRun, wg); err != nil {
+	//				return err
+	//			}
+	//
+	//			return nil
+	//		}
+
+	if haveArgsChanged(set) {
+		// remove and restart
+		if set.BlueGreenMode == container.BGModeOn {
+			ContainerInfoLog(set.Name, "Run arguments changed, doing blue-green redeploy...")
+			if err = set.BlueGreenDeploy(attach, dryRun, wg); err != nil {
+				return err
+			}
+		} else {
+			ContainerInfoLog(set.Name, "Removing (run arguments changed)")
+			if err = set.RecreateAndRun(attach, dryRun, wg); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		//start if stopped
-		if err = set.Start(attach, &wg); err != nil {
+	// eg. the network was added to the config after the container was created
+	if !dryRun {
+		if err := set.JoinNetwork(); err != nil {
 			return err
 		}
-		continue
+	}
 
+	//attach if running
+	if set.State.Running {
+		ContainerInfoLog(set.Name, "Already running.")
+		if attach {
+			ContainerInfoLog(set.Name, "Attaching")
+			if err := set.Attach(wg); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	wg.Wait()
-	if !dryRun && attach {
-		<-allDone
+
+	ContainerInfoLog(set.Name, "Starting...")
+
+	if dryRun {
+		return nil
 	}
-	return nil
+
+	//start if stopped
+	return set.Start(attach, wg)
 }
 
 // Starts stopped containers
 func (settings SettingsList) CapitanStart(attach bool, dryRun bool) error {
 	sort.Sort(settings)
-	wg := sync.WaitGroup{}
+	var (
+		wg      = sync.WaitGroup{}
+		aborted bool
+	)
 	for _, set := range settings {
+		if wasInterrupted() {
+			aborted = true
+			break
+		}
 
 		if set.State.Running {
 			ContainerInfoLog(set.Name, "Already running")
@@ -421,15 +630,22 @@ func (settings SettingsList) CapitanStart(attach bool, dryRun bool) error {
 		}
 		ContainerInfoLog(set.Name, "Starting")
 		if !dryRun {
-			if err := set.Start(attach, &wg); err != nil {
+			changeLock.Lock()
+			err := set.Start(attach, &wg)
+			changeLock.Unlock()
+			if err != nil {
 				return err
 			}
 		}
 	}
 	wg.Wait()
-	if !dryRun && attach {
+	if !dryRun && attach && wasInterrupted() {
 		<-allDone
 	}
+	// stopped by an interrupt while attached counts as a failure too
+	if aborted || wasInterrupted() {
+		return errInterrupted
+	}
 	return nil
 }
 
@@ -449,8 +665,23 @@ func (settings SettingsList) CapitanRestart(args []string, dryRun bool) error {
 }
 
 // Print all container IPs
-func (settings SettingsList) CapitanIP() error {
+func (settings SettingsList) CapitanIP(format string) error {
 	sort.Sort(settings)
+	if isStructuredOutput(format) {
+		reports := make([]*IPReport, 0, len(settings))
+		for _, set := range settings {
+			ips, err := helpers.GetContainerIPs(set.Name)
+			if err != nil {
+				// not created, or gone
+				ips = map[string]string{}
+			}
+			reports = append(reports, &IPReport{
+				ContainerIdent: newContainerIdent(set),
+				Networks:       ips,
+			})
+		}
+		return printStructured(format, reports)
+	}
 	for _, set := range settings {
 		ips := set.IPs()
 		ContainerInfoLog(set.Name, ips)
@@ -458,50 +689,139 @@ func (settings SettingsList) CapitanIP() error {
 	return nil
 }
 
-// Stream all container logs
-func (settings SettingsList) CapitanLogs() error {
+// Stream all container logs.
+// When following, containers replacing these (blue/green redeploys,
+// scaling from elsewhere) are picked up as they start, if they match the filter.
+func (settings SettingsList) CapitanLogs(opts container.LogOptions, filter ContainerFilter) error {
 	sort.Sort(settings)
+	if opts.Follow && len(settings) > 0 {
+		newLogFollower(settings, opts, filter, settings[0].ProjectName).Run(settings)
+		return nil
+	}
+
 	var wg sync.WaitGroup
 	for _, set := range settings {
-		var (
-			ses *sh.Session
-			err error
-		)
-		if ses, err = set.Logs(); err != nil {
-			Error.Println("Error getting log for " + set.Name + ": " + err.Error())
-			continue
-		}
-
 		wg.Add(1)
-
-		go func() {
-			ses.Wait()
-			wg.Done()
-		}()
-
+		go func(set *container.Container) {
+			defer wg.Done()
+			if err := set.Logs(opts); err != nil {
+				Error.Println("Error getting log for " + set.Name + ": " + err.Error())
+			}
+		}(set)
 	}
 	wg.Wait()
 	return nil
 }
 
-// Stream all container stats
-func (settings SettingsList) CapitanStats() error {
+// Filter down to the given service types, keeping every instance and colour of each.
+// No service types means no filtering.
+func (settings SettingsList) FilterServiceTypes(types []string) (SettingsList, error) {
+	if len(types) == 0 {
+		return settings, nil
+	}
+	for _, svcType := range types {
+		if len(settings.Filter(func(i *container.Container) bool {
+			return i.ServiceType == svcType
+		})) == 0 {
+			return nil, errors.New("No such service: " + svcType)
+		}
+	}
+	return settings.Filter(func(i *container.Container) bool {
+		return helpers.StringInSlice(i.ServiceType, types)
+	}), nil
+}
+
+// Take a single sample of stats for each running container
+func (settings SettingsList) statsSnapshot() ([]*StatsReport, error) {
+	running := settings.Filter(func(i *container.Container) bool {
+		return i.State.Running
+	})
+	reports := make([]*StatsReport, 0, len(running))
+	if len(running) == 0 {
+		return reports, nil
+	}
+
+	names := make([]string, len(running))
+	for i, set := range running {
+		names[i] = set.Name
+	}
+	snaps, err := helpers.GetStatsSnapshot(names)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range running {
+		if snap, found := snaps[set.Name]; found {
+			reports = append(reports, newStatsReport(set, snap))
+		}
+	}
+	return reports, nil
+}
+
+// Stream all container stats.
+// Machine readable formats get a single sample instead of a stream.
+// With noStream a single sample is taken and summed up per service.
+func (settings SettingsList) CapitanStats(noStream bool, format string) error {
 	var (
 		args []interface{}
 	)
 	sort.Sort(settings)
 
-	args = make([]interface{}, len(settings))
+	if noStream {
+		reports, err := settings.statsSnapshot()
+		if err != nil {
+			return err
+		}
+		services := newServiceStatsReports(reports)
+		if isStructuredOutput(format) {
+			return printStructured(format, services)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tCONTAINERS\tCPU %\tMEM USAGE\tNET I/O\tBLOCK I/O\tPIDS")
+		for _, svc := range services {
+			fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%s\t%s / %s\t%s / %s\t%d\n",
+				svc.Service,
+				len(svc.Containers),
+				svc.CPUPercent,
+				helpers.FormatSize(svc.MemoryUsage),
+				helpers.FormatSize(svc.NetworkRx),
+				helpers.FormatSize(svc.NetworkTx),
+				helpers.FormatSize(svc.BlockRead),
+				helpers.FormatSize(svc.BlockWrite),
+				svc.PIDs,
+			)
+		}
+		return w.Flush()
+	}
 
-	for i, set := range settings {
+	if isStructuredOutput(format) {
+		reports, err := settings.statsSnapshot()
+		if err != nil {
+			return err
+		}
+		return printStructured(format, reports)
+	}
+
+	// docker refuses to stream stats for containers which don't exist
+	existing := settings.Filter(func(i *container.Container) bool {
+		return i.State.ID != ""
+	})
+	if len(existing) == 0 {
+		return errors.New("No containers to show stats for")
+	}
+
+	args = make([]interface{}, len(existing))
+
+	for i, set := range existing {
 		args[i] = set.Name
 	}
 
-	ses := sh.NewSession()
+	ses := shellsession.NewSession()
 	ses.Command("docker", append([]interface{}{"stats"}, args...)...)
-	ses.Start()
-	ses.Wait()
-	return nil
+	if err := ses.Start(); err != nil {
+		return err
+	}
+	return ses.Wait()
 }
 
 // Kill all running containers in project
@@ -606,7 +926,9 @@ func (settings SettingsList) CapitanShow() error {
 		if tmpl, err = template.New("containerStringer").Parse(containerShowTemplate); err != nil {
 			return err
 		}
-		set.RunArguments = set.GetRunArguments()
+		if set.RunArguments, err = set.GetRunArguments(); err != nil {
+			return err
+		}
 		if err = tmpl.Execute(os.Stdout, set); err != nil {
 			return err
 		}
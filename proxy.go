@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"github.com/byrnedo/capitan/shellsession"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// A reverse proxy config rendered from the live containers whenever they change,
+// set with `global proxy_template`, `global proxy_output` and `global proxy_reload`
+type ProxyConfig struct {
+	// a template file, or the name of a built-in one
+	Template string
+	// the file rendered to
+	Output string
+	// shell command run after the output changes
+	Reload string
+	tmpl   *template.Template
+}
+
+// What proxy templates are given
+type ProxyData struct {
+	Project string
+	// the `global network`, if there is one
+	Network  string
+	Services []*LiveService
+	// services by name, eg. {{with index .Service "app"}}
+	Service map[string]*LiveService
+}
+
+// Templates which can be given by name instead of a file
+var builtinProxyTemplates = map[string]string{
+	"nginx":   nginxProxyTemplate,
+	"haproxy": haproxyProxyTemplate,
+}
+
+// An upstream for each service with a published port and an instance to send to, include it in nginx's http block
+const nginxProxyTemplate = `# Generated by capitan for {{.Project}}, changes will be overwritten
+{{range $svc := .Services}}{{if and $svc.Port $svc.HasIP}}
+# {{$svc.Name}}, live colour {{$svc.Color}}
+upstream {{$.Project}}_{{$svc.Name}} {
+{{- range $svc.Instances}}{{if .IP}}
+    server {{.IP}}:{{$svc.Port}};
+{{- end}}{{end}}
+}
+{{end}}{{end}}`
+
+// A backend for each service with a published port and an instance to send to, load it alongside the main config
+const haproxyProxyTemplate = `# Generated by capitan for {{.Project}}, changes will be overwritten
+{{range $svc := .Services}}{{if and $svc.Port $svc.HasIP}}
+# {{$svc.Name}}, live colour {{$svc.Color}}
+backend {{$.Project}}_{{$svc.Name}}
+    balance roundrobin
+{{- range $svc.Instances}}{{if .IP}}
+    server {{.Name}} {{.IP}}:{{$svc.Port}} check
+{{- end}}{{end}}
+{{end}}{{end}}`
+
+// Read and parse the template
+func (p *ProxyConfig) load() error {
+	if p.Output == "" {
+		return errors.New("`proxy_output` must be given with `proxy_template`")
+	}
+	text, found := builtinProxyTemplates[p.Template]
+	if !found {
+		data, err := ioutil.ReadFile(p.Template)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New(filepath.Base(p.Template)).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return err
+	}
+	p.tmpl = tmpl
+	return nil
+}
+
+// Update the proxy config after the running containers changed, whether or not
+// the command changing them succeeded. False if it failed, which is logged.
+func (settings *ProjectConfig) refreshProxy(dryRun bool) bool {
+	if err := settings.updateProxy(nil, dryRun); err != nil {
+		Error.Println("Proxy update failed:", err)
+		return false
+	}
+	return true
+}
+
+// Render the proxy config from the running containers, leaving out those in exclude,
+// and run the reload command if it changed. If the reload fails the previous config is put back.
+func (settings *ProjectConfig) updateProxy(exclude SettingsList, dryRun bool) error {
+	proxy := settings.Proxy
+	if proxy == nil {
+		return nil
+	}
+	services, err := settings.liveServices(exclude)
+	if err != nil {
+		return err
+	}
+	data := ProxyData{
+		Project:  settings.ProjectName,
+		Network:  settings.Network,
+		Services: services,
+		Service:  make(map[string]*LiveService, len(services)),
+	}
+	for _, svc := range services {
+		data.Service[svc.Name] = svc
+	}
+	var out bytes.Buffer
+	if err = proxy.tmpl.Execute(&out, data); err != nil {
+		return err
+	}
+
+	previous, readErr := ioutil.ReadFile(proxy.Output)
+	if readErr == nil && bytes.Equal(previous, out.Bytes()) {
+		return nil
+	}
+	Info.Println("Updating proxy config " + proxy.Output + "...")
+	if dryRun {
+		return nil
+	}
+	if err = helpers.WriteFileAtomic(proxy.Output, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	if proxy.Reload == "" {
+		return nil
+	}
+	if err = settings.reloadProxy(); err != nil {
+		// the proxy is still on the previous config, keep the file in step with it
+		if readErr == nil {
+			helpers.WriteFileAtomic(proxy.Output, previous, 0644)
+		} else {
+			os.Remove(proxy.Output)
+		}
+		return errors.New("Proxy reload failed: " + err.Error())
+	}
+	return nil
+}
+
+func (settings *ProjectConfig) reloadProxy() error {
+	Info.Println("Reloading proxy...")
+	ses := shellsession.NewShellSession(func(s *shellsession.ShellSession) {
+		s.SetEnv("CAPITAN_PROJECT_NAME", settings.ProjectName)
+		s.SetEnv("CAPITAN_PROXY_OUTPUT", settings.Proxy.Output)
+	})
+	ses.Command("bash", "-c", settings.Proxy.Reload)
+	ses.Stdout = os.Stdout
+	ses.Stderr = os.Stderr
+	return ses.Run()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	. "github.com/byrnedo/capitan/logger"
+	"gopkg.in/yaml.v2"
+	"sort"
+)
+
+// Output formats for the --output flag
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputYAML = "yaml"
+)
+
+// Container states used in reports
+const (
+	StateRunning = "running"
+	StateStopped = "stopped"
+	// defined in config but not created
+	StateMissing = "missing"
+)
+
+// Reasons a container differs from the config
+const (
+	DriftNone = ""
+	// the run arguments have changed since it was created
+	DriftConfig = "config changed"
+	// in config but not created
+	DriftMissing = "missing"
+	// an instance above the configured scale
+	DriftScaledOut = "scaled-out"
+	// its service is no longer in the config
+	DriftOrphan = "orphan"
+)
+
+// Whether the format is one of the machine readable ones
+func isStructuredOutput(format string) bool {
+	return format == OutputJSON || format == OutputYAML
+}
+
+// Print a report in a machine readable format
+func printStructured(format string, v interface{}) error {
+	var (
+		out []byte
+		err error
+	)
+	switch format {
+	case OutputJSON:
+		out, err = json.MarshalIndent(v, "", "  ")
+	case OutputYAML:
+		out, err = yaml.Marshal(v)
+	default:
+		return errors.New("Unsupported output format: " + format)
+	}
+	if err != nil {
+		return err
+	}
+	Info.Println(string(out))
+	return nil
+}
+
+// The fields identifying a container, common to all reports
+type ContainerIdent struct {
+	Name     string `json:"name" yaml:"name"`
+	Service  string `json:"service" yaml:"service"`
+	Instance int    `json:"instance" yaml:"instance"`
+	Colour   string `json:"colour" yaml:"colour"`
+}
+
+func newContainerIdent(set *container.Container) ContainerIdent {
+	return ContainerIdent{
+		Name:     set.Name,
+		Service:  set.ServiceType,
+		Instance: set.InstanceNumber,
+		Colour:   set.State.Color,
+	}
+}
+
+// Report for the 'ps' command
+type PsReport struct {
+	ContainerIdent `yaml:",inline"`
+	ID             string `json:"id" yaml:"id"`
+	// one of running, stopped or missing
+	State  string `json:"state" yaml:"state"`
+	Status string `json:"status" yaml:"status"`
+	Image  string `json:"image" yaml:"image"`
+	// hash of the run arguments the container was created with
+	ArgsHash string `json:"argsHash" yaml:"argsHash"`
+	// hash of the run arguments in the current config
+	ConfigHash string `json:"configHash" yaml:"configHash"`
+	// the container differs from the current config
+	Drift bool `json:"drift" yaml:"drift"`
+	// why it differs, one of the Drift* values
+	DriftReason string   `json:"driftReason" yaml:"driftReason"`
+	Ports       []string `json:"ports" yaml:"ports"`
+}
+
+func containerState(set *container.Container) string {
+	switch {
+	case set.State.ID == "":
+		return StateMissing
+	case set.State.Running:
+		return StateRunning
+	default:
+		return StateStopped
+	}
+}
+
+// How a container from the config differs from what's running
+func configDrift(set *container.Container) string {
+	if containerState(set) == StateMissing {
+		return DriftMissing
+	}
+	if !set.ArgsUpToDate(set.State.ArgsHash) {
+		return DriftConfig
+	}
+	return DriftNone
+}
+
+// Build a ps report, drift is given for containers not from the config list
+func newPsReport(set *container.Container, drift string) *PsReport {
+	var configHash string
+	if drift != DriftOrphan {
+		// left empty if the config can't be expanded, running it reports why
+		if args, err := set.HashArguments(); err == nil {
+			configHash = container.ArgsHash(args)
+		}
+	}
+	ports := set.State.Ports
+	if ports == nil {
+		ports = []string{}
+	}
+	return &PsReport{
+		ContainerIdent: newContainerIdent(set),
+		ID:             set.State.ID,
+		State:          containerState(set),
+		Status:         set.State.Status,
+		Image:          set.State.Image,
+		ArgsHash:       set.State.ArgsHash,
+		ConfigHash:     configHash,
+		Drift:          drift != DriftNone,
+		DriftReason:    drift,
+		Ports:          ports,
+	}
+}
+
+// Reports for every container in the project, orphans only if asked for
+func newPsReports(settings *ProjectConfig, all bool) []*PsReport {
+	sort.Sort(settings.ContainerList)
+	reports := make([]*PsReport, 0, len(settings.ContainerList))
+	for _, set := range settings.ContainerList {
+		reports = append(reports, newPsReport(set, configDrift(set)))
+	}
+	sort.Sort(settings.ContainerCleanupList)
+	for _, set := range settings.ContainerCleanupList {
+		reports = append(reports, newPsReport(set, DriftScaledOut))
+	}
+	if all {
+		sort.Sort(settings.OrphanList)
+		for _, set := range settings.OrphanList {
+			reports = append(reports, newPsReport(set, DriftOrphan))
+		}
+	}
+	return reports
+}
+
+// Report for the 'ip' command
+type IPReport struct {
+	ContainerIdent `yaml:",inline"`
+	// network name -> ip address
+	Networks map[string]string `json:"networks" yaml:"networks"`
+}
+
+// Report for the 'stats' command, a single sample
+type StatsReport struct {
+	ContainerIdent `yaml:",inline"`
+	CPUPercent     float64 `json:"cpuPercent" yaml:"cpuPercent"`
+	MemoryUsage    uint64  `json:"memoryUsage" yaml:"memoryUsage"`
+	MemoryLimit    uint64  `json:"memoryLimit" yaml:"memoryLimit"`
+	MemoryPercent  float64 `json:"memoryPercent" yaml:"memoryPercent"`
+	NetworkRx      uint64  `json:"networkRx" yaml:"networkRx"`
+	NetworkTx      uint64  `json:"networkTx" yaml:"networkTx"`
+	BlockRead      uint64  `json:"blockRead" yaml:"blockRead"`
+	BlockWrite     uint64  `json:"blockWrite" yaml:"blockWrite"`
+	PIDs           int     `json:"pids" yaml:"pids"`
+}
+
+func newStatsReport(set *container.Container, snap *helpers.StatsSnapshot) *StatsReport {
+	return &StatsReport{
+		ContainerIdent: newContainerIdent(set),
+		CPUPercent:     snap.CPUPercent,
+		MemoryUsage:    snap.MemoryUsage,
+		MemoryLimit:    snap.MemoryLimit,
+		MemoryPercent:  snap.MemoryPercent,
+		NetworkRx:      snap.NetworkRx,
+		NetworkTx:      snap.NetworkTx,
+		BlockRead:      snap.BlockRead,
+		BlockWrite:     snap.BlockWrite,
+		PIDs:           snap.PIDs,
+	}
+}
+
+// Stats summed up across every instance and colour of a service
+type ServiceStatsReport struct {
+	Service       string  `json:"service" yaml:"service"`
+	CPUPercent    float64 `json:"cpuPercent" yaml:"cpuPercent"`
+	MemoryUsage   uint64  `json:"memoryUsage" yaml:"memoryUsage"`
+	MemoryPercent float64 `json:"memoryPercent" yaml:"memoryPercent"`
+	NetworkRx     uint64  `json:"networkRx" yaml:"networkRx"`
+	NetworkTx     uint64  `json:"networkTx" yaml:"networkTx"`
+	BlockRead     uint64  `json:"blockRead" yaml:"blockRead"`
+	BlockWrite    uint64  `json:"blockWrite" yaml:"blockWrite"`
+	PIDs          int     `json:"pids" yaml:"pids"`
+	// the samples summed up
+	Containers []*StatsReport `json:"containers" yaml:"containers"`
+}
+
+// Sum up container stats per service, in the order the services are first seen
+func newServiceStatsReports(reports []*StatsReport) []*ServiceStatsReport {
+	services := make([]*ServiceStatsReport, 0)
+	byName := make(map[string]*ServiceStatsReport)
+	for _, ctr := range reports {
+		svc, found := byName[ctr.Service]
+		if !found {
+			svc = &ServiceStatsReport{
+				Service:    ctr.Service,
+				Containers: make([]*StatsReport, 0),
+			}
+			byName[ctr.Service] = svc
+			services = append(services, svc)
+		}
+		svc.CPUPercent += ctr.CPUPercent
+		svc.MemoryUsage += ctr.MemoryUsage
+		svc.MemoryPercent += ctr.MemoryPercent
+		svc.NetworkRx += ctr.NetworkRx
+		svc.NetworkTx += ctr.NetworkTx
+		svc.BlockRead += ctr.BlockRead
+		svc.BlockWrite += ctr.BlockWrite
+		svc.PIDs += ctr.PIDs
+		svc.Containers = append(svc.Containers, ctr)
+	}
+	return services
+}
+
+// Report for the 'show' command
+type ShowReport struct {
+	Project    string              `json:"project" yaml:"project"`
+	Separator  string              `json:"separator" yaml:"separator"`
+	BlueGreen  bool                `json:"blueGreen" yaml:"blueGreen"`
+	Hooks      map[string][]string `json:"hooks" yaml:"hooks"`
+	Containers []*ContainerShow    `json:"containers" yaml:"containers"`
+}
+
+// A container as interpreted from config, part of ShowReport
+type ContainerShow struct {
+	ContainerIdent `yaml:",inline"`
+	ID             string              `json:"id" yaml:"id"`
+	Running        bool                `json:"running" yaml:"running"`
+	ArgsHash       string              `json:"argsHash" yaml:"argsHash"`
+	Image          string              `json:"image" yaml:"image"`
+	Build          string              `json:"build,omitempty" yaml:"build,omitempty"`
+	Order          int                 `json:"order" yaml:"order"`
+	Profiles       []string            `json:"profiles,omitempty" yaml:"profiles,omitempty"`
+	BlueGreen      bool                `json:"blueGreen" yaml:"blueGreen"`
+	StableName     string              `json:"stableName,omitempty" yaml:"stableName,omitempty"`
+	Network        string              `json:"network,omitempty" yaml:"network,omitempty"`
+	Links          []string            `json:"links" yaml:"links"`
+	Hooks          map[string][]string `json:"hooks" yaml:"hooks"`
+	Scale          int                 `json:"scale" yaml:"scale"`
+	VolumesFrom    []string            `json:"volumesFrom" yaml:"volumesFrom"`
+	RunArguments   []string            `json:"runArguments" yaml:"runArguments"`
+}
+
+func newContainerShow(set *container.Container) (*ContainerShow, error) {
+	args, err := set.GetRunArguments()
+	if err != nil {
+		return nil, err
+	}
+	links := make([]string, len(set.Links))
+	for i, link := range set.Links {
+		links[i] = link.Container
+		if link.Alias != "" {
+			links[i] += ":" + link.Alias
+		}
+	}
+	hooks := make(map[string][]string, len(set.Hooks))
+	for name, hook := range set.Hooks {
+		hooks[name] = hook.Scripts
+	}
+	volumesFrom := set.VolumesFrom
+	if volumesFrom == nil {
+		volumesFrom = []string{}
+	}
+	return &ContainerShow{
+		ContainerIdent: newContainerIdent(set),
+		ID:             set.State.ID,
+		Running:        set.State.Running,
+		ArgsHash:       set.State.ArgsHash,
+		Image:          set.Image,
+		Build:          set.Build,
+		Order:          set.Placement,
+		Profiles:       set.Profiles,
+		BlueGreen:      set.BlueGreenMode == container.BGModeOn,
+		StableName:     string(set.StableName),
+		Network:        set.Network,
+		Links:          links,
+		Hooks:          hooks,
+		Scale:          set.Scale,
+		VolumesFrom:    volumesFrom,
+		RunArguments:   helpers.ToStringSlice(args),
+	}, nil
+}
+
+func newShowReport(settings *ProjectConfig) (*ShowReport, error) {
+	hooks := make(map[string][]string, len(settings.Hooks))
+	for name, hook := range settings.Hooks {
+		hooks[name] = hook.Scripts
+	}
+	list := settings.ContainerList
+	sort.Sort(list)
+	containers := make([]*ContainerShow, len(list))
+	for i, set := range list {
+		show, err := newContainerShow(set)
+		if err != nil {
+			return nil, err
+		}
+		containers[i] = show
+	}
+	return &ShowReport{
+		Project:    settings.ProjectName,
+		Separator:  settings.ProjectSeparator,
+		BlueGreen:  settings.BlueGreenMode,
+		Hooks:      hooks,
+		Containers: containers,
+	}, nil
+}
+
+// Exit codes for the 'status' command, in order of precedence
+const (
+	StatusInSync = 0
+	// containers need creating, recreating or scaling down
+	StatusChangesPending = 2
+	// containers exist but are stopped
+	StatusContainersDown = 3
+	// containers whose service is no longer in the config
+	StatusOrphansPresent = 4
+)
+
+// Report for the 'status' command
+type StatusReport struct {
+	Project string `json:"project" yaml:"project"`
+	InSync  bool   `json:"inSync" yaml:"inSync"`
+	// one of "in sync", "changes pending", "containers down" or "orphans present"
+	Result   string `json:"result" yaml:"result"`
+	ExitCode int    `json:"exitCode" yaml:"exitCode"`
+	Pending  int    `json:"pending" yaml:"pending"`
+	Down     int    `json:"down" yaml:"down"`
+	Orphans  int    `json:"orphans" yaml:"orphans"`
+	// every container in the project, including orphans
+	Containers []*PsReport `json:"containers" yaml:"containers"`
+}
+
+func newStatusReport(settings *ProjectConfig) *StatusReport {
+	report := &StatusReport{
+		Project:    settings.ProjectName,
+		Containers: newPsReports(settings, true),
+	}
+	for _, ctr := range report.Containers {
+		switch {
+		case ctr.DriftReason == DriftOrphan:
+			report.Orphans++
+		case ctr.Drift:
+			report.Pending++
+		case ctr.State == StateStopped:
+			report.Down++
+		}
+	}
+
+	switch {
+	case report.Pending > 0:
+		report.Result, report.ExitCode = "changes pending", StatusChangesPending
+	case report.Down > 0:
+		report.Result, report.ExitCode = "containers down", StatusContainersDown
+	case report.Orphans > 0:
+		report.Result, report.ExitCode = "orphans present", StatusOrphansPresent
+	default:
+		report.Result, report.ExitCode = "in sync", StatusInSync
+		report.InSync = true
+	}
+	return report
+}
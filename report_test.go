@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/byrnedo/capitan/container"
+	"github.com/byrnedo/capitan/helpers"
+	"strconv"
+	"testing"
+)
+
+// A container for report tests, created with the config's args when upToDate
+func reportContainer(t *testing.T, service string, instance int, state *helpers.ServiceState, upToDate bool) *container.Container {
+	set := &container.Container{
+		Name:                 "proj_" + service + "_" + state.Color + "_" + strconv.Itoa(instance),
+		ProjectName:          "proj",
+		ProjectNameSeparator: "_",
+		ServiceType:          service,
+		InstanceNumber:       instance,
+		Image:                "nginx",
+		State:                state,
+	}
+	if upToDate {
+		args, err := set.HashArguments()
+		if err != nil {
+			t.Fatalf("%s: %v", service, err)
+		}
+		state.ArgsHash = container.ArgsHash(args)
+	}
+	return set
+}
+
+func TestNewPsReports(t *testing.T) {
+	running := reportContainer(t, "web", 1, &helpers.ServiceState{ID: "a", Running: true, Color: "blue"}, true)
+	changed := reportContainer(t, "db", 1, &helpers.ServiceState{ID: "b", Running: true, Color: "blue", ArgsHash: "stale"}, false)
+	missing := reportContainer(t, "cache", 1, &helpers.ServiceState{Color: "blue"}, false)
+	scaled := reportContainer(t, "web", 2, &helpers.ServiceState{ID: "c", Color: "blue"}, true)
+	orphan := reportContainer(t, "old", 1, &helpers.ServiceState{ID: "d", Color: "blue"}, false)
+	settings := &ProjectConfig{
+		ContainerList:        SettingsList{running, changed, missing},
+		ContainerCleanupList: SettingsList{scaled},
+		OrphanList:           SettingsList{orphan},
+	}
+
+	tests := []struct {
+		name  string
+		all   bool
+		want  []string
+		drift []string
+		state []string
+	}{
+		{
+			"without orphans", false,
+			[]string{"cache", "db", "web", "web"},
+			[]string{DriftMissing, DriftConfig, DriftNone, DriftScaledOut},
+			[]string{StateMissing, StateRunning, StateRunning, StateStopped},
+		},
+		{
+			"with orphans", true,
+			[]string{"cache", "db", "web", "web", "old"},
+			[]string{DriftMissing, DriftConfig, DriftNone, DriftScaledOut, DriftOrphan},
+			[]string{StateMissing, StateRunning, StateRunning, StateStopped, StateStopped},
+		},
+	}
+	for _, test := range tests {
+		reports := newPsReports(settings, test.all)
+		if len(reports) != len(test.want) {
+			t.Errorf("%s: got %d reports, want %d", test.name, len(reports), len(test.want))
+			continue
+		}
+		for i, report := range reports {
+			if report.Service != test.want[i] || report.DriftReason != test.drift[i] || report.State != test.state[i] {
+				t.Errorf("%s: report %d got %s/%q/%s, want %s/%q/%s", test.name, i,
+					report.Service, report.DriftReason, report.State, test.want[i], test.drift[i], test.state[i])
+			}
+			if report.Drift != (test.drift[i] != DriftNone) {
+				t.Errorf("%s: report %d got drift %v for %q", test.name, i, report.Drift, report.DriftReason)
+			}
+			if report.Ports == nil {
+				t.Errorf("%s: report %d got nil ports", test.name, i)
+			}
+			if (report.ConfigHash == "") != (test.drift[i] == DriftOrphan) {
+				t.Errorf("%s: report %d got config hash %q", test.name, i, report.ConfigHash)
+			}
+		}
+	}
+}
+
+func TestNewStatusReport(t *testing.T) {
+	var (
+		inSync = func() *container.Container {
+			return reportContainer(t, "web", 1, &helpers.ServiceState{ID: "a", Running: true, Color: "blue"}, true)
+		}
+		stopped = func() *container.Container {
+			return reportContainer(t, "web", 1, &helpers.ServiceState{ID: "a", Color: "blue"}, true)
+		}
+		changed = func() *container.Container {
+			return reportContainer(t, "web", 1, &helpers.ServiceState{ID: "a", Running: true, Color: "blue", ArgsHash: "stale"}, false)
+		}
+		orphan = func() *container.Container {
+			return reportContainer(t, "old", 1, &helpers.ServiceState{ID: "b", Color: "blue"}, false)
+		}
+		adopted = func() *container.Container {
+			return reportContainer(t, "web", 1, &helpers.ServiceState{ID: "a", Running: true, Color: "blue", Adopted: true}, false)
+		}
+	)
+
+	tests := []struct {
+		name     string
+		list     SettingsList
+		cleanup  SettingsList
+		orphans  SettingsList
+		want     int
+		wantSync bool
+	}{
+		{"in sync", SettingsList{inSync()}, nil, nil, StatusInSync, true},
+		{"empty", nil, nil, nil, StatusInSync, true},
+		{"pending", SettingsList{changed()}, nil, nil, StatusChangesPending, false},
+		{"adopted", SettingsList{adopted()}, nil, nil, StatusInSync, true},
+		{"scaled out", SettingsList{inSync()}, SettingsList{stopped()}, nil, StatusChangesPending, false},
+		{"down", SettingsList{stopped()}, nil, nil, StatusContainersDown, false},
+		{"orphans", SettingsList{inSync()}, nil, SettingsList{orphan()}, StatusOrphansPresent, false},
+		{"pending over down", SettingsList{changed(), stopped()}, nil, nil, StatusChangesPending, false},
+		{"pending over orphans", SettingsList{changed()}, nil, SettingsList{orphan()}, StatusChangesPending, false},
+		{"down over orphans", SettingsList{stopped()}, nil, SettingsList{orphan()}, StatusContainersDown, false},
+	}
+	for _, test := range tests {
+		report := newStatusReport(&ProjectConfig{
+			ProjectName:          "proj",
+			ContainerList:        test.list,
+			ContainerCleanupList: test.cleanup,
+			OrphanList:           test.orphans,
+		})
+		if report.ExitCode != test.want || report.InSync != test.wantSync {
+			t.Errorf("%s: got exit code %d (in sync %v), want %d (in sync %v)", test.name, report.ExitCode, report.InSync, test.want, test.wantSync)
+		}
+		if len(report.Containers) != len(test.list)+len(test.cleanup)+len(test.orphans) {
+			t.Errorf("%s: got %d containers, want %d", test.name, len(report.Containers), len(test.list)+len(test.cleanup)+len(test.orphans))
+		}
+	}
+}
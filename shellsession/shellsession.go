@@ -1,20 +1,155 @@
 package shellsession
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/byrnedo/capitan/logger"
-	"github.com/codeskyblue/go-sh"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
+var (
+	// set once capitan handles interrupts itself, see IsolateInterrupts
+	isolated int32
+
+	// commands running in their own process group
+	groupsLock sync.Mutex
+	groups     = make(map[*exec.Cmd]bool)
+)
+
+// A command run by capitan, eg. docker or a hook script
 type ShellSession struct {
-	*sh.Session
+	// added to capitan's own environment
+	Env    map[string]string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// print each command before running it
+	ShowCMD bool
+	dir     string
+	cmd     *exec.Cmd
 }
 
 func NewShellSession(init func(*ShellSession)) *ShellSession {
-	ses := ShellSession{sh.NewSession()}
+	ses := NewSession()
+	init(ses)
+	return ses
+}
+
+func NewSession() *ShellSession {
+	ses := &ShellSession{
+		Env:    make(map[string]string),
+		Stdin:  strings.NewReader(""),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
 	if logger.GetLevel() == logger.DebugLevel {
 		ses.ShowCMD = true
 	}
-	init(&ses)
-	return &ses
+	return ses
+}
+
+// Run commands started from now on in their own process group.
+// Ctrl-C goes to the terminal's whole foreground group, this keeps it
+// to capitan so it can decide what to stop. Commands reading the terminal
+// are left in the foreground group, they'd be stopped by the first read otherwise.
+func IsolateInterrupts() {
+	atomic.StoreInt32(&isolated, 1)
+}
+
+// Pass an interrupt on to the commands running in their own process group,
+// for when capitan exits without waiting for them
+func InterruptAll() {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	for cmd := range groups {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+	}
+}
+
+func (s *ShellSession) SetEnv(key string, value string) *ShellSession {
+	s.Env[key] = value
+	return s
+}
+
+func (s *ShellSession) SetDir(dir string) *ShellSession {
+	s.dir = dir
+	return s
+}
+
+// Set the command to run, arguments are passed as they are, never through a shell
+func (s *ShellSession) Command(name string, args ...interface{}) *ShellSession {
+	strArgs := make([]string, len(args))
+	for i, arg := range args {
+		strArgs[i] = fmt.Sprint(arg)
+	}
+	s.cmd = exec.Command(name, strArgs...)
+	return s
 }
 
+func (s *ShellSession) Start() error {
+	s.cmd.Dir = s.dir
+	s.cmd.Env = os.Environ()
+	for key, value := range s.Env {
+		s.cmd.Env = append(s.cmd.Env, key+"="+value)
+	}
+	s.cmd.Stdin = s.Stdin
+	s.cmd.Stdout = s.Stdout
+	s.cmd.Stderr = s.Stderr
+	if s.ShowCMD {
+		fmt.Fprintln(s.Stderr, "$", strings.Join(s.cmd.Args, " "))
+	}
+
+	ownGroup := atomic.LoadInt32(&isolated) == 1 && s.Stdin != os.Stdin
+	if ownGroup {
+		s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	if err := s.cmd.Start(); err != nil {
+		return err
+	}
+	if ownGroup {
+		groupsLock.Lock()
+		groups[s.cmd] = true
+		groupsLock.Unlock()
+	}
+	return nil
+}
+
+func (s *ShellSession) Wait() error {
+	err := s.cmd.Wait()
+	groupsLock.Lock()
+	delete(groups, s.cmd)
+	groupsLock.Unlock()
+	return err
+}
+
+func (s *ShellSession) Run() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// Run the command and return what it wrote to stdout
+func (s *ShellSession) Output() ([]byte, error) {
+	stdout := s.Stdout
+	defer func() {
+		s.Stdout = stdout
+	}()
+	var out bytes.Buffer
+	s.Stdout = &out
+	err := s.Run()
+	return out.Bytes(), err
+}
+
+// Signal the command, if it's running
+func (s *ShellSession) Kill(sig os.Signal) {
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Signal(sig)
+	}
+}